@@ -0,0 +1,90 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// Reconnect statistics, written to the SNMP log.
+var (
+	reconnectAttempts = std.NewCounter("ReconnectAttempts")
+	reconnectFailures = std.NewCounter("ReconnectFailures")
+)
+
+// backoff spaces out the reconnect attempts of one session: the delay
+// doubles from min up to max after every consecutive failure, and up to
+// jitter percent of it is randomized so clients cut off by the same outage
+// do not come back in lockstep.
+type backoff struct {
+	min, max    time.Duration
+	jitter      int // percent of the delay
+	maxAttempts int // consecutive failures before giving up, 0 for never
+	failures    int
+}
+
+// newBackoff creates the backoff configured by the reconnect* options.
+func newBackoff(config *Config) *backoff {
+	return &backoff{
+		min:         time.Duration(config.ReconnectDelay) * time.Second,
+		max:         time.Duration(config.ReconnectMax) * time.Second,
+		jitter:      config.ReconnectJitter,
+		maxAttempts: config.ReconnectAttempts,
+	}
+}
+
+// delay returns how long to wait after the current number of failures.
+func (b *backoff) delay() time.Duration {
+	d := b.max
+	if b.failures <= 32 {
+		if exp := b.min << (b.failures - 1); exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	if b.jitter > 0 {
+		d -= time.Duration(rand.Int64N(int64(d)*int64(b.jitter)/100 + 1))
+	}
+	return d
+}
+
+// fail records a failed attempt and sleeps until the next one is due. The
+// process exits once maxAttempts consecutive attempts have failed.
+func (b *backoff) fail(err error) {
+	reconnectFailures.Inc()
+	b.failures++
+	if b.maxAttempts > 0 && b.failures >= b.maxAttempts {
+		checkError(errors.Wrapf(err, "giving up after %d failed connection attempts", b.failures))
+	}
+
+	d := b.delay()
+	log.Println("re-connecting:", err, "retry in:", d)
+	time.Sleep(d)
+}
+
+// reset starts over from min after a successful connection.
+func (b *backoff) reset() { b.failures = 0 }
@@ -0,0 +1,75 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{6, 10 * time.Second},
+	} {
+		b.failures = tt.failures
+		if got := b.delay(); got != tt.want {
+			t.Fatalf("delay after %d failures: got %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// The delay never overflows however long the outage lasts.
+	b.failures = 1000
+	if got := b.delay(); got != b.max {
+		t.Fatalf("delay after 1000 failures: got %v, want %v", got, b.max)
+	}
+
+	b.reset()
+	b.failures++
+	if got := b.delay(); got != b.min {
+		t.Fatalf("delay after reset: got %v, want %v", got, b.min)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := &backoff{min: time.Second, max: 8 * time.Second, jitter: 50, failures: 4}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := b.delay()
+		if d < 4*time.Second || d > 8*time.Second {
+			t.Fatalf("jittered delay %v outside [4s, 8s]", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("jitter did not randomize the delay")
+	}
+}
@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// listenPath opens the UDP socket of a session sent over path, a local IP
+// address or the name of an interface, to reach raddr. Pinning the sessions
+// of the pool to different paths spreads them over several uplinks.
+func listenPath(path string, raddr *net.UDPAddr) (net.PacketConn, error) {
+	network := "udp4"
+	if raddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	if ip := net.ParseIP(path); ip != nil {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+		return conn, errors.WithStack(err)
+	}
+	return listenInterface(network, path)
+}
+
+// interfaceAddr returns the first address of interface name in the family
+// of network.
+func interfaceAddr(network, name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == (network == "udp4") {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, errors.Errorf("no %v address on interface %v", network, name)
+}
@@ -0,0 +1,45 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenPath(t *testing.T) {
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 29900}
+
+	conn, err := listenPath("127.0.0.1", raddr)
+	if err != nil {
+		t.Fatalf("listenPath returned error: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.LocalAddr().(*net.UDPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("socket bound to %v, want 127.0.0.1", addr)
+	}
+
+	if _, err := listenPath("no-such-interface0", raddr); err == nil {
+		t.Fatal("expected error for a missing interface")
+	}
+}
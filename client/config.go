@@ -28,12 +28,37 @@ import (
 
 // Config models the client-side configuration loaded via flags or JSON.
 type Config struct {
-	std.BaseConfig        // Embed shared configuration
-	LocalAddr      string `json:"localaddr"`
-	RemoteAddr     string `json:"remoteaddr"`
-	Conn           int    `json:"conn"`
-	AutoExpire     int    `json:"autoexpire"`
-	ScavengeTTL    int    `json:"scavengettl"`
+	std.BaseConfig                  // Embed shared configuration
+	LocalAddr         string        `json:"localaddr"`
+	RemoteAddr        string        `json:"remoteaddr"`
+	Target            string        `json:"target"` // destination requested from the server, empty for the server's default
+	Conn              int           `json:"conn"`
+	AutoExpire        int           `json:"autoexpire"`
+	ScavengeTTL       int           `json:"scavengettl"`
+	SOCKS5            bool          `json:"socks5"`
+	SOCKS5User        string        `json:"socks5user"`
+	SOCKS5Pass        string        `json:"socks5pass"`
+	HTTP              bool          `json:"http"`
+	TProxy            string        `json:"tproxy"`        // transparent proxy mode: "redirect" or "tproxy", linux only
+	SendSource        bool          `json:"sendsource"`    // send the local client address with each stream
+	ProxyProtocol     bool          `json:"proxyprotocol"` // expect PROXY protocol headers on the listeners
+	ProxyTrusted      []string      `json:"proxytrusted"`  // peers allowed to send them, as CIDRs or IPs
+	UDP               string        `json:"udp"`
+	UDPTimeout        int           `json:"udptimeout"`
+	Reverse           []string      `json:"reverse"`           // reverse tunnels as name=localtarget
+	Forwards          []ForwardRule `json:"forwards"`          // extra listeners with their own target
+	Select            string        `json:"select"`            // session selection strategy, see newSessionSelector
+	Bind              []string      `json:"bind"`              // local addresses or interfaces the sessions are spread over
+	WaitQueue         int           `json:"waitqueue"`         // clients allowed to wait while no session is up
+	ReconnectDelay    int           `json:"reconnectdelay"`    // seconds before the first retry, doubled per failure
+	ReconnectMax      int           `json:"reconnectmax"`      // upper bound of the retry delay in seconds
+	ReconnectJitter   int           `json:"reconnectjitter"`   // percent of the retry delay that is randomized
+	ReconnectAttempts int           `json:"reconnectattempts"` // consecutive failures before exiting, 0 for never
+	Stdio             bool          `json:"stdio"`             // pipe one stream to stdin/stdout, eg: as ssh ProxyCommand
+	Redundant         bool          `json:"redundant"`         // send the streams of localaddr over two sessions at once
+	PortHop           int           `json:"porthop"`           // seconds between moves of a session to another remote port, 0 to disable
+	Migrate           bool          `json:"migrate"`           // keep sessions up when the local address changes
+	Resume            int           `json:"resume"`            // seconds a stream may wait for another session when its own dies, 0 to disable
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -26,8 +26,10 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	kcp "github.com/xtaci/kcp-go/v5"
@@ -36,45 +38,125 @@ import (
 )
 
 var (
-	multiPort           *std.MultiPort
-	multiPortParseError error
-	multiPortOnce       sync.Once
+	remotes           *remoteSet
+	remotesParseError error
+	remotesOnce       sync.Once
 )
 
-// dial establishes a connection to the configured remote endpoint.
-func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
-	// Parse the multiPort definition only once.
-	multiPortOnce.Do(func() {
-		multiPort, multiPortParseError = std.ParseMultiPort(config.RemoteAddr)
+// dial establishes a connection over path to one of the configured remote
+// endpoints, chosen by their priority, weight and health.
+func dial(config *Config, block kcp.BlockCrypt, path string) (*kcp.UDPSession, *remote, error) {
+	// Parse the remote endpoints only once.
+	remotesOnce.Do(func() {
+		remotes, remotesParseError = parseRemotes(config.RemoteAddr)
+		if remotesParseError == nil {
+			remotes.probe = func(r *remote) error { return probeRemote(config, block, r) }
+		}
 	})
 
-	// Abort when the multiPort definition is invalid.
-	if multiPortParseError != nil {
-		return nil, multiPortParseError
+	// Abort when the remote endpoints are invalid.
+	if remotesParseError != nil {
+		return nil, nil, remotesParseError
 	}
 
-	// Pick a random destination port within the configured range.
+	r := remotes.pick()
+	kcpconn, err := dialRemote(config, block, r.mp, path)
+	if err != nil {
+		remotes.fail(r)
+		return nil, nil, err
+	}
+	return kcpconn, r, nil
+}
+
+// probeRemote tells whether r is working again by dialing a session to it,
+// see sessionProvenAfter.
+func probeRemote(config *Config, block kcp.BlockCrypt, r *remote) error {
+	kcpconn, err := dialRemote(config, block, r.mp, "")
+	if err != nil {
+		return err
+	}
+	session, err := newSmuxSession(config, kcpconn)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	select {
+	case <-session.CloseChan():
+		return errors.New("no answer from server")
+	case <-time.After(sessionProvenAfter):
+		return nil
+	}
+}
+
+// randomPort picks a random port within the range of multiPort.
+func randomPort(multiPort *std.MultiPort) (uint64, error) {
 	var randport uint64
 	err := binary.Read(rand.Reader, binary.LittleEndian, &randport)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return uint64(multiPort.MinPort) + randport%uint64(multiPort.MaxPort-multiPort.MinPort+1), nil
+}
 
-	remoteAddr := fmt.Sprintf("%v:%v", multiPort.Host, uint64(multiPort.MinPort)+randport%uint64(multiPort.MaxPort-multiPort.MinPort+1))
+// dialRemote establishes a connection to the endpoint multiPort, sent over
+// path when it is not empty, see listenPath.
+func dialRemote(config *Config, block kcp.BlockCrypt, multiPort *std.MultiPort, path string) (*kcp.UDPSession, error) {
+	// Pick a random destination port within the configured range.
+	port, err := randomPort(multiPort)
+	if err != nil {
+		return nil, err
+	}
 
-	// Use tcpraw to emulate a TCP transport when requested.
-	if config.TCP {
-		conn, err := tcpraw.Dial("tcp", remoteAddr)
-		if err != nil {
-			return nil, errors.Wrap(err, "tcpraw.Dial()")
-		}
+	remoteAddr := fmt.Sprintf("%v:%v", multiPort.Host, port)
+	hop := config.PortHop > 0 && multiPort.MaxPort > multiPort.MinPort
 
+	// Sessions pinned to a path, hopping ports, migrating, or carried by
+	// tcpraw to emulate a TCP transport, bring their own socket.
+	if config.TCP || path != "" || hop || config.Migrate {
 		udpaddr, err := net.ResolveUDPAddr("udp", remoteAddr)
 		if err != nil {
-			conn.Close()
 			return nil, errors.WithStack(err)
 		}
 
+		var conn net.PacketConn
+		switch {
+		case config.TCP:
+			if conn, err = tcpraw.Dial("tcp", remoteAddr); err != nil {
+				return nil, errors.Wrap(err, "tcpraw.Dial()")
+			}
+		case path != "":
+			if conn, err = listenPath(path, udpaddr); err != nil {
+				return nil, errors.Wrapf(err, "path %v", path)
+			}
+		default:
+			// The same as kcp.DialWithOptions.
+			network := "udp4"
+			if udpaddr.IP.To4() == nil {
+				network = "udp"
+			}
+			if conn, err = net.ListenUDP(network, nil); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		if hop {
+			hc := std.NewHopConn(conn, udpaddr)
+			go hopPorts(hc, multiPort, time.Duration(config.PortHop)*time.Second, config.Quiet)
+			conn = hc
+		}
+		if config.Migrate {
+			ac, err := std.NewAnnounceConn(conn, udpaddr, []byte(config.Key))
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			// Announced ahead of the first KCP packet, so the server
+			// knows the session from the start.
+			ac.Announce()
+			go keepAnnounced(ac, udpaddr, config.Quiet)
+			conn = ac
+		}
+
 		var convid uint32
 		if err := binary.Read(rand.Reader, binary.LittleEndian, &convid); err != nil {
 			conn.Close()
@@ -92,3 +174,26 @@ func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
 	// Otherwise fall back to the standard UDP dialing path.
 	return kcp.DialWithOptions(remoteAddr, block, config.DataShard, config.ParityShard)
 }
+
+// hopPorts moves conn to another random port of multiPort every interval,
+// until it is closed along with its session.
+func hopPorts(conn *std.HopConn, multiPort *std.MultiPort, interval time.Duration, quiet bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			port, err := randomPort(multiPort)
+			if err != nil {
+				log.Println("port hop:", err)
+				continue
+			}
+			from := conn.Hop(int(port))
+			if !quiet {
+				log.Println("port hop:", conn.LocalAddr(), "->", fmt.Sprintf("%v:%v", multiPort.Host, port), "from port:", from)
+			}
+		case <-conn.Done():
+			return
+		}
+	}
+}
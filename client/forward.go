@@ -0,0 +1,155 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/qpp"
+)
+
+// ForwardRule forwards the clients accepted on Listen to Target through the
+// shared sessions. Unset per-rule settings fall back to the global ones.
+type ForwardRule struct {
+	Listen    string `json:"listen"`
+	Target    string `json:"target"`
+	Quiet     *bool  `json:"quiet"`
+	CloseWait *int   `json:"closewait"`
+	Comp      *bool  `json:"comp"`      // compress the streams of this rule, see compStreams
+	Redundant bool   `json:"redundant"` // send every stream over two sessions, see handleClient
+	Resume    *int   `json:"resume"`    // seconds a stream may wait for another session, see resumer
+}
+
+// parseForwardRule parses a rule given on the command line as
+// "listen->target".
+func parseForwardRule(s string) (ForwardRule, error) {
+	listen, target, found := strings.Cut(s, "->")
+	rule := ForwardRule{Listen: strings.TrimSpace(listen), Target: strings.TrimSpace(target)}
+	if !found {
+		return rule, errors.Errorf("forward %q: expected listen->target", s)
+	}
+	return rule, rule.validate()
+}
+
+// validate checks that the rule names both ends.
+func (r *ForwardRule) validate() error {
+	if r.Listen == "" || r.Target == "" {
+		return errors.Errorf("forward %q->%q: listen and target are required", r.Listen, r.Target)
+	}
+	return nil
+}
+
+// compStreams reports whether the streams of the rule are compressed on
+// their own, which is only needed when the sessions do not compress, with
+// noComp. The rule follows the sessions unless it sets comp.
+func (r *ForwardRule) compStreams(noComp bool) bool {
+	return r.Comp != nil && *r.Comp && noComp
+}
+
+// targetHeader builds the header requesting target, a unix socket path when
+// it is not host:port.
+func targetHeader(target string, comp bool) *std.Header {
+	hdr := &std.Header{Network: "tcp", Addr: target, Comp: comp}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		hdr.Network = "unix"
+	}
+	return hdr
+}
+
+// listenLocal listens on a TCP address, or on a unix socket path when addr is
+// not host:port.
+func listenLocal(addr string) (net.Listener, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		uaddr, err := net.ResolveUnixAddr("unix", addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		listener, err := net.ListenUnix("unix", uaddr)
+		return listener, errors.WithStack(err)
+	}
+
+	taddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	listener, err := net.ListenTCP("tcp", taddr)
+	return listener, errors.WithStack(err)
+}
+
+// serveForward assigns each client accepted on listener to a rotating smux
+// session of the pool, which refreshes sessions on demand so parallel TCP
+// streams keep flowing smoothly. With pp set, every client must start with a
+// PROXY protocol header from a trusted peer. With redundant set, every
+// client is carried by two sessions at once when the pool has them. With rs
+// set, every client gets a resumable stream. quiet is asked for every client,
+// as reloads change it.
+func serveForward(listener net.Listener, pool *sessionPool, pp *proxyAcceptor, acl *std.ACL, handshake handshakeFunc, redundant bool, rs *resumer, _Q_ *qpp.QuantumPermutationPad, seed []byte, quiet func() bool, closeWait int) {
+	legs := 1
+	if redundant {
+		legs = redundantLegs
+	}
+	std.OnShutdown(func() { listener.Close() })
+	for {
+		p1, err := listener.Accept()
+		if err != nil {
+			if std.Draining() {
+				return
+			}
+			log.Fatalf("%+v", err)
+		}
+		if pp != nil && !pp.isTrusted(p1.RemoteAddr()) {
+			log.Println("proxy protocol: untrusted peer", "in:", p1.RemoteAddr())
+			p1.Close()
+			continue
+		}
+
+		// Serve the accepted client in its own goroutine, so waiting for a
+		// session never holds up the accept loop.
+		go func(p1 net.Conn) {
+			if pp != nil {
+				conn, err := pp.accept(p1)
+				if err != nil {
+					log.Println(err, "in:", p1.RemoteAddr())
+					p1.Close()
+					return
+				}
+				p1 = conn
+			}
+			if !acl.Admit(p1.RemoteAddr()) {
+				p1.Close()
+				return
+			}
+			sessions, err := pool.getN(p1.RemoteAddr(), legs)
+			if err != nil {
+				log.Println(err, "in:", p1.RemoteAddr())
+				p1.Close()
+				return
+			}
+			handleClient(_Q_, seed, sessions, p1, handshake, rs, quiet(), closeWait)
+		}(p1)
+	}
+}
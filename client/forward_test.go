@@ -0,0 +1,82 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import "testing"
+
+func TestParseForwardRule(t *testing.T) {
+	rule, err := parseForwardRule(":2222 -> 10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("parseForwardRule returned error: %v", err)
+	}
+	if rule.Listen != ":2222" || rule.Target != "10.0.0.1:22" {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+
+	for _, s := range []string{":2222", "->10.0.0.1:22", ":2222->"} {
+		if _, err := parseForwardRule(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func TestParseJSONConfigForwards(t *testing.T) {
+	path := writeTempClientConfig(t, `{
+		"forwards": [
+			{"listen": ":2222", "target": "10.0.0.1:22", "quiet": true, "closewait": 0, "resume": 30},
+			{"listen": "/tmp/web.sock", "target": "10.0.0.2:80", "comp": true}
+		]
+	}`)
+
+	var cfg Config
+	if err := parseJSONConfig(&cfg, path); err != nil {
+		t.Fatalf("parseJSONConfig returned error: %v", err)
+	}
+	if len(cfg.Forwards) != 2 {
+		t.Fatalf("expected 2 forward rules, got %d", len(cfg.Forwards))
+	}
+
+	ssh, web := cfg.Forwards[0], cfg.Forwards[1]
+	if ssh.Quiet == nil || !*ssh.Quiet || ssh.CloseWait == nil || *ssh.CloseWait != 0 || ssh.Comp != nil || ssh.Resume == nil || *ssh.Resume != 30 {
+		t.Fatalf("unexpected per-rule settings: %+v", ssh)
+	}
+	if web.Quiet != nil || web.CloseWait != nil || web.Resume != nil || web.Comp == nil || !*web.Comp {
+		t.Fatalf("unset settings must stay nil: %+v", web)
+	}
+	if hdr := targetHeader(web.Target, web.compStreams(true)); hdr.Network != "tcp" || !hdr.Comp {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+
+	// Rules follow the sessions, which compress every stream unless nocomp.
+	if ssh.compStreams(true) || ssh.compStreams(false) || web.compStreams(false) {
+		t.Fatal("expected streams compressed on their own only for comp rules with nocomp")
+	}
+	off := false
+	ssh.Comp = &off
+	if ssh.compStreams(true) {
+		t.Fatal("expected comp: false to leave the streams uncompressed")
+	}
+	if hdr := targetHeader("/run/app.sock", false); hdr.Network != "unix" {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+}
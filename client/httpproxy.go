@@ -0,0 +1,127 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// httpHandshake returns a handshakeFunc acting as an HTTP/1.1 proxy. CONNECT
+// requests are tunneled as-is, absolute-URI requests for plain HTTP are
+// rewritten to origin-form and sent to the requested host.
+func httpHandshake() handshakeFunc {
+	return func(p1 net.Conn) (*std.Header, replyFunc, error) {
+		br := bufio.NewReader(p1)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "http")
+		}
+
+		if req.Method == http.MethodConnect {
+			addr := withDefaultPort(req.Host, "443")
+			reply := func(p2 io.Writer, code byte) error {
+				if code != std.ReplyOK {
+					return httpError(p1, code)
+				}
+				if _, err := io.WriteString(p1, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+					return errors.WithStack(err)
+				}
+				// Clients may send the first bytes of the tunnel, such as a TLS
+				// ClientHello, without waiting for the 200.
+				return forwardBuffered(br, p2)
+			}
+			return &std.Header{Network: "tcp", Addr: addr}, reply, nil
+		}
+
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			httpStatus(p1, http.StatusBadRequest)
+			return nil, nil, errors.Errorf("http: unsupported request target %q", req.RequestURI)
+		}
+
+		addr := withDefaultPort(req.URL.Host, "80")
+		reply := func(p2 io.Writer, code byte) error {
+			if code != std.ReplyOK {
+				return httpError(p1, code)
+			}
+
+			req.Header.Del("Proxy-Connection")
+			req.Header.Del("Proxy-Authorization")
+			// One connection is bound to one destination, ask the origin to
+			// close afterwards so the next request comes back to the proxy.
+			req.Close = true
+			if err := req.Write(p2); err != nil {
+				return errors.WithStack(err)
+			}
+			return forwardBuffered(br, p2)
+		}
+		return &std.Header{Network: "tcp", Addr: addr}, reply, nil
+	}
+}
+
+// withDefaultPort appends port to hostport when it does not carry one.
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	// An IPv6 host comes in brackets, which JoinHostPort adds again.
+	if len(hostport) > 1 && hostport[0] == '[' && hostport[len(hostport)-1] == ']' {
+		hostport = hostport[1 : len(hostport)-1]
+	}
+	return net.JoinHostPort(hostport, port)
+}
+
+// forwardBuffered flushes bytes read ahead by br into w.
+func forwardBuffered(br *bufio.Reader, w io.Writer) error {
+	if n := br.Buffered(); n > 0 {
+		buf, _ := br.Peek(n)
+		if _, err := w.Write(buf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// httpError answers with the status matching a failed server reply code.
+func httpError(w io.Writer, code byte) error {
+	switch code {
+	case std.ReplyNotAllowed:
+		return httpStatus(w, http.StatusForbidden)
+	case std.ReplyTimeout:
+		return httpStatus(w, http.StatusGatewayTimeout)
+	default:
+		return httpStatus(w, http.StatusBadGateway)
+	}
+}
+
+// httpStatus writes a bodiless response with the given status code.
+func httpStatus(w io.Writer, status int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	return errors.WithStack(err)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestHTTPHandshakeConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\nearly"))
+
+	hdr, reply, err := httpHandshake()(server)
+	if err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	if hdr.Addr != "example.com:8443" {
+		t.Fatalf("unexpected addr: %q", hdr.Addr)
+	}
+
+	var tunnel bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- reply(&tunnel, std.ReplyOK) }()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %v %v", resp, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("reply returned error: %v", err)
+	}
+	if tunnel.String() != "early" {
+		t.Fatalf("early tunnel bytes not forwarded: %q", tunnel.String())
+	}
+}
+
+func TestHTTPHandshakeAbsoluteURI(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("POST http://example.com/path?q=1 HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\nContent-Length: 4\r\n\r\nbody"))
+
+	hdr, reply, err := httpHandshake()(server)
+	if err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	if hdr.Addr != "example.com:80" {
+		t.Fatalf("unexpected addr: %q", hdr.Addr)
+	}
+
+	var upstream bytes.Buffer
+	if err := reply(&upstream, std.ReplyOK); err != nil {
+		t.Fatalf("reply returned error: %v", err)
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(&upstream))
+	if err != nil {
+		t.Fatalf("rewritten request is invalid: %v", err)
+	}
+	if req.RequestURI != "/path?q=1" || req.Header.Get("Proxy-Connection") != "" || !req.Close {
+		t.Fatalf("unexpected rewritten request: %+v", req)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "body" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := []struct {
+		hostport, want string
+	}{
+		{"example.com", "example.com:80"},
+		{"example.com:8080", "example.com:8080"},
+		{"10.0.0.1", "10.0.0.1:80"},
+		{"[::1]", "[::1]:80"},
+		{"[::1]:8080", "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := withDefaultPort(tt.hostport, "80"); got != tt.want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", tt.hostport, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		code   byte
+		status int
+	}{
+		{std.ReplyRefused, http.StatusBadGateway},
+		{std.ReplyUnreachable, http.StatusBadGateway},
+		{std.ReplyTimeout, http.StatusGatewayTimeout},
+		{std.ReplyNotAllowed, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := httpError(&out, tt.code); err != nil {
+			t.Fatalf("httpError returned error: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+		if err != nil || resp.StatusCode != tt.status {
+			t.Fatalf("code %d: got %v %v, want %d", tt.code, resp, err, tt.status)
+		}
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -51,6 +52,11 @@ const (
 	maxSmuxVer = 2
 	// scavengePeriod defines how frequently expired sessions are purged.
 	scavengePeriod = 5
+	// handshakeTimeout bounds how long a local proxy client may take to name
+	// its destination.
+	handshakeTimeout = 30 * time.Second
+	// dialTimeout bounds dialing the local target of a reverse tunnel.
+	dialTimeout = 10 * time.Second
 )
 
 // VERSION is populated via build flags when packaging official binaries.
@@ -70,12 +76,118 @@ func main() {
 		cli.StringFlag{
 			Name:  "localaddr,l",
 			Value: ":12948",
-			Usage: "local listen address",
+			Usage: "local listen address, empty to only serve -forward rules",
 		},
 		cli.StringFlag{
 			Name:  "remoteaddr, r",
 			Value: "vps:29900",
-			Usage: `kcp server address, eg: "IP:29900" a for single port, "IP:minport-maxport" for port range`,
+			Usage: `kcp server address, eg: "IP:29900" a for single port, "IP:minport-maxport" for port range, several servers separated by commas, each with optional ";priority=N;weight=N"`,
+		},
+		cli.StringFlag{
+			Name:  "target, t",
+			Value: "",
+			Usage: `ask the server to forward streams to this destination instead of its own target, eg: "10.0.0.1:22", requires -allowtarget on the server`,
+		},
+		cli.BoolFlag{
+			Name:  "socks5",
+			Usage: "serve SOCKS5 on localaddr and let the server dial the requested destinations, requires -allowtarget on the server",
+		},
+		cli.StringFlag{
+			Name:  "socks5user",
+			Value: "",
+			Usage: "require SOCKS5 username/password authentication with this username",
+		},
+		cli.StringFlag{
+			Name:   "socks5pass",
+			Value:  "",
+			Usage:  "password for SOCKS5 username/password authentication",
+			EnvVar: "KCPTUN_SOCKS5_PASS",
+		},
+		cli.BoolFlag{
+			Name:  "http",
+			Usage: "serve as an HTTP/1.1 proxy (CONNECT and absolute-URI requests) on localaddr, requires -allowtarget on the server",
+		},
+		cli.StringFlag{
+			Name:  "tproxy",
+			Value: "",
+			Usage: `serve as a transparent proxy on localaddr for connections redirected by the firewall: "redirect" for REDIRECT, "tproxy" for TPROXY (linux), requires -allowtarget on the server`,
+		},
+		cli.BoolFlag{
+			Name:  "sendsource",
+			Usage: "send the address of every local client with its stream, for servers writing PROXY protocol headers (-proxyprotocol)",
+		},
+		cli.BoolFlag{
+			Name:  "proxyprotocol",
+			Usage: "expect a PROXY protocol v1/v2 header on every connection accepted by localaddr and the forward rules, eg: behind HAProxy",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxytrusted",
+			Usage: `accept PROXY protocol headers only from these networks, eg: "10.0.0.0/8", "192.168.1.10", repeatable`,
+		},
+		cli.StringFlag{
+			Name:  "udp",
+			Value: "",
+			Usage: "also listen for UDP on this address and forward the datagrams to target over UDP, requires -udp on the server",
+		},
+		cli.IntFlag{
+			Name:  "udptimeout",
+			Value: 60,
+			Usage: "seconds before an idle UDP flow releases its stream",
+		},
+		cli.StringFlag{
+			Name:  "select",
+			Value: selectRoundRobin,
+			Usage: "how new connections pick one of the conn sessions: rr, leaststreams, rtt, sticky",
+		},
+		cli.StringSliceFlag{
+			Name:  "bind",
+			Usage: "local address or interface to send a conn session through, repeat to spread the sessions over several uplinks",
+		},
+		cli.IntFlag{
+			Name:  "waitqueue",
+			Value: 128,
+			Usage: "max number of connections waiting while no session is up, the rest are closed",
+		},
+		cli.IntFlag{
+			Name:  "reconnectdelay",
+			Value: 1,
+			Usage: "seconds to wait after a failed connection attempt, doubled after each further failure",
+		},
+		cli.IntFlag{
+			Name:  "reconnectmax",
+			Value: 60,
+			Usage: "max seconds between connection attempts",
+		},
+		cli.IntFlag{
+			Name:  "reconnectjitter",
+			Value: 50,
+			Usage: "percent of the reconnect delay that is randomized, 0-100",
+		},
+		cli.IntFlag{
+			Name:  "reconnectattempts",
+			Value: 0,
+			Usage: "exit after this many consecutive failed connection attempts, 0 to retry forever",
+		},
+		cli.BoolFlag{
+			Name:  "redundant",
+			Usage: "send every stream accepted on localaddr over two sessions at once and keep the copy arriving first, for latency-critical traffic, requires -redundant on the server",
+		},
+		cli.IntFlag{
+			Name:  "resume",
+			Value: 0,
+			Usage: "let streams accepted on localaddr wait this many seconds for another session when theirs dies and carry on without a reset, 0 to disable, requires -resume on the server",
+		},
+		cli.BoolFlag{
+			Name:  "stdio",
+			Usage: `pipe a single stream to stdin/stdout instead of listening, eg: ssh -o ProxyCommand="client -stdio -c conf.json" host`,
+		},
+		cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: `also listen on a local address and forward its clients to a target through the same sessions, eg: ":2222->10.0.0.1:22", requires -allowtarget on the server, repeatable`,
+		},
+		cli.StringSliceFlag{
+			Name:  "reverse",
+			Usage: `serve a reverse tunnel registered on the server by name, eg: "ssh=127.0.0.1:22", requires -reverse on the server, repeatable`,
 		},
 		cli.StringFlag{
 			Name:   "key",
@@ -107,6 +219,15 @@ func main() {
 			Value: 1,
 			Usage: "set num of UDP connections to server",
 		},
+		cli.IntFlag{
+			Name:  "porthop",
+			Value: 0,
+			Usage: "move every session to another random port of the remote port range every N seconds without dropping its streams, 0 to disable, requires -porthop on the server",
+		},
+		cli.BoolFlag{
+			Name:  "migrate",
+			Usage: "keep sessions up when the local address changes, eg: when switching networks, requires -migrate on the server",
+		},
 		cli.IntFlag{
 			Name:  "autoexpire",
 			Value: 0,
@@ -216,6 +337,24 @@ func main() {
 			Value: 0,
 			Usage: "the seconds to wait before tearing down a connection",
 		},
+		cli.IntFlag{
+			Name:  "drain",
+			Value: std.EXIT_WAIT,
+			Usage: "on SIGTERM, stop accepting and give the open streams this many seconds to finish before exiting",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowip",
+			Usage: `only accept connections from this IP or CIDR range, eg: "10.0.0.0/8", repeatable`,
+		},
+		cli.StringSliceFlag{
+			Name:  "denyip",
+			Usage: `refuse connections from this IP or CIDR range, over -allowip, repeatable`,
+		},
+		cli.StringFlag{
+			Name:  "aclfile",
+			Value: "",
+			Usage: "read more -allowip and -denyip rules from this file, as lines of \"allow CIDR\" or \"deny CIDR\", it is read again once it changed",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -253,11 +392,40 @@ func main() {
 		config := Config{}
 		config.LocalAddr = c.String("localaddr")
 		config.RemoteAddr = c.String("remoteaddr")
+		config.Target = c.String("target")
+		config.SOCKS5 = c.Bool("socks5")
+		config.SOCKS5User = c.String("socks5user")
+		config.SOCKS5Pass = c.String("socks5pass")
+		config.HTTP = c.Bool("http")
+		config.TProxy = c.String("tproxy")
+		config.SendSource = c.Bool("sendsource")
+		config.ProxyProtocol = c.Bool("proxyprotocol")
+		config.ProxyTrusted = c.StringSlice("proxytrusted")
+		config.UDP = c.String("udp")
+		config.UDPTimeout = c.Int("udptimeout")
+		config.Reverse = c.StringSlice("reverse")
+		config.Stdio = c.Bool("stdio")
+		config.Select = c.String("select")
+		config.WaitQueue = c.Int("waitqueue")
+		config.Bind = c.StringSlice("bind")
+		config.Redundant = c.Bool("redundant")
+		config.Resume = c.Int("resume")
+		config.ReconnectDelay = c.Int("reconnectdelay")
+		config.ReconnectMax = c.Int("reconnectmax")
+		config.ReconnectJitter = c.Int("reconnectjitter")
+		config.ReconnectAttempts = c.Int("reconnectattempts")
+		for _, s := range c.StringSlice("forward") {
+			rule, err := parseForwardRule(s)
+			checkError(err)
+			config.Forwards = append(config.Forwards, rule)
+		}
 		config.Key = c.String("key")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.Conn = c.Int("conn")
 		config.AutoExpire = c.Int("autoexpire")
+		config.PortHop = c.Int("porthop")
+		config.Migrate = c.Bool("migrate")
 		config.ScavengeTTL = c.Int("scavengettl")
 		config.MTU = c.Int("mtu")
 		config.RateLimit = c.Int("ratelimit")
@@ -287,6 +455,11 @@ func main() {
 		config.QPP = c.Bool("QPP")
 		config.QPPCount = c.Int("QPPCount")
 		config.CloseWait = c.Int("closewait")
+		config.Drain = c.Int("drain")
+		config.AllowIP = c.StringSlice("allowip")
+		config.DenyIP = c.StringSlice("denyip")
+		config.ACLFile = c.String("aclfile")
+		flags := config
 
 		if c.String("c") != "" {
 			err := parseJSONConfig(&config, c.String("c"))
@@ -296,6 +469,96 @@ func main() {
 		if config.Conn <= 0 {
 			log.Fatal("conn must be greater than 0")
 		}
+		if _, err := parseRemotes(config.RemoteAddr); err != nil {
+			log.Fatal(err)
+		}
+		if config.PortHop < 0 {
+			log.Fatal("porthop must not be negative")
+		}
+		if config.PortHop > 0 && config.TCP {
+			log.Fatal("porthop cannot be used with tcp")
+		}
+		if config.Migrate && config.TCP {
+			log.Fatal("migrate cannot be used with tcp")
+		}
+		if len(config.Bind) > 0 && config.TCP {
+			log.Fatal("bind cannot be used with tcp")
+		}
+		if len(config.Bind) > config.Conn {
+			log.Fatal("conn must be at least the number of bind paths")
+		}
+		if config.WaitQueue < 0 {
+			log.Fatal("waitqueue must not be negative")
+		}
+		if config.ReconnectDelay <= 0 || config.ReconnectMax < config.ReconnectDelay {
+			log.Fatal("reconnectdelay must be greater than 0 and not above reconnectmax")
+		}
+		if config.ReconnectJitter < 0 || config.ReconnectJitter > 100 {
+			log.Fatal("reconnectjitter must be between 0 and 100")
+		}
+		if config.ReconnectAttempts < 0 {
+			log.Fatal("reconnectattempts must not be negative")
+		}
+
+		if config.Resume < 0 {
+			log.Fatal("resume must not be negative")
+		}
+		redundant := config.Redundant
+		resumable := config.Redundant && config.Resume > 0
+		for i, rule := range config.Forwards {
+			checkError(config.Forwards[i].validate())
+			redundant = redundant || rule.Redundant
+			resume := config.Resume
+			if rule.Resume != nil {
+				resume = *rule.Resume
+			}
+			if resume < 0 {
+				log.Fatal("resume must not be negative")
+			}
+			resumable = resumable || rule.Redundant && resume > 0
+		}
+		if redundant && config.Conn < redundantLegs {
+			log.Fatal("redundant streams need conn of at least 2")
+		}
+		if resumable {
+			log.Fatal("redundant streams cannot be resumable")
+		}
+
+		if config.Stdio && (config.SOCKS5 || config.HTTP || config.TProxy != "") {
+			log.Fatal("stdio cannot be enabled together with socks5, http or tproxy")
+		}
+
+		if !config.Stdio && config.LocalAddr == "" && len(config.Forwards) == 0 && config.UDP == "" && len(config.Reverse) == 0 {
+			log.Fatal("nothing to serve, set localaddr or forward rules")
+		}
+
+		if config.SOCKS5 && config.HTTP {
+			log.Fatal("socks5 and http cannot be enabled at the same time")
+		}
+
+		switch config.TProxy {
+		case "":
+		case tproxyRedirect, tproxyTPROXY:
+			if config.SOCKS5 || config.HTTP {
+				log.Fatal("tproxy cannot be enabled together with socks5 or http")
+			}
+			if config.LocalAddr == "" {
+				log.Fatal("tproxy requires localaddr")
+			}
+		default:
+			log.Fatal("unsupported tproxy mode: ", config.TProxy)
+		}
+
+		if config.ProxyProtocol && len(config.ProxyTrusted) == 0 {
+			log.Fatal("proxyprotocol requires proxytrusted")
+		}
+		if config.ProxyProtocol && config.TProxy != "" {
+			log.Fatal("proxyprotocol cannot be enabled together with tproxy")
+		}
+
+		if config.UDP != "" && config.UDPTimeout <= 0 {
+			log.Fatal("udptimeout must be greater than 0")
+		}
 
 		if config.RateLimit < 0 {
 			log.Printf("ratelimit %d is negative, falling back to 0", config.RateLimit)
@@ -304,40 +567,62 @@ func main() {
 
 		// Redirect logs when the user supplied a dedicated log file.
 		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+			checkError(std.OpenLog(config.Log))
+		} else if config.Stdio {
+			// stderr belongs to the program running us, only failures go there.
+			log.SetOutput(io.Discard)
+		}
+		if config.Stdio {
+			fatalOutput = os.Stderr
 		}
 
 		// Apply mode presets using the shared configuration helper.
 		config.ApplyMode()
 
+		// Re-read the config file on SIGHUP. In stdio mode SIGHUP ends the
+		// client as usual, OpenSSH sends it to its ProxyCommand.
+		var running atomic.Pointer[Config]
+		running.Store(&config)
+		if path := c.String("c"); path != "" && !config.Stdio {
+			r := &reloader{path: path, flags: flags, loaded: config, running: &running}
+			std.OnReload(func() {
+				if err := r.reload(); err != nil {
+					log.Println("reload:", err)
+				}
+			})
+		} else if !config.Stdio {
+			std.OnReload(func() { log.Println("reload: no config file given with -c") })
+		}
+
 		log.Println("version:", VERSION)
 		var listener net.Listener
-		var isUnix bool
-		if _, _, err := net.SplitHostPort(config.LocalAddr); err != nil {
-			isUnix = true
-		}
-		if isUnix {
-			addr, err := net.ResolveUnixAddr("unix", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenUnix("unix", addr)
-			checkError(err)
-		} else {
-			addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenTCP("tcp", addr)
+		if config.LocalAddr != "" && !config.Stdio {
+			var err error
+			if config.TProxy != "" {
+				listener, err = listenTransparent(config.TProxy, config.LocalAddr)
+			} else {
+				listener, err = listenLocal(config.LocalAddr)
+			}
 			checkError(err)
 		}
 
 		log.Println("smux version:", config.SmuxVer)
-		log.Println("listening on:", listener.Addr())
+		if listener != nil {
+			log.Println("listening on:", listener.Addr())
+		}
 		log.Println("encryption:", config.Crypt)
 		log.Println("QPP:", config.QPP)
 		log.Println("QPP Count:", config.QPPCount)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("remote address:", config.RemoteAddr)
+		log.Println("target:", config.Target)
+		log.Println("socks5:", config.SOCKS5, "auth:", config.SOCKS5User != "")
+		log.Println("http:", config.HTTP)
+		log.Println("tproxy:", config.TProxy)
+		log.Println("sendsource:", config.SendSource)
+		log.Println("proxyprotocol:", config.ProxyProtocol, "trusted:", config.ProxyTrusted)
+		log.Println("udp:", config.UDP, "udptimeout:", config.UDPTimeout)
+		log.Println("reverse:", config.Reverse)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
 		log.Println("compression:", !config.NoComp)
 		log.Println("mtu:", config.MTU)
@@ -352,19 +637,22 @@ func main() {
 		log.Println("keepalive:", config.KeepAlive)
 		log.Println("conn:", config.Conn)
 		log.Println("autoexpire:", config.AutoExpire)
+		log.Println("porthop:", config.PortHop)
+		log.Println("migrate:", config.Migrate)
+		log.Println("resume:", config.Resume)
 		log.Println("scavengettl:", config.ScavengeTTL)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
 		log.Println("quiet:", config.Quiet)
+		log.Println("drain:", config.Drain)
+		log.Println("allowip:", config.AllowIP, "denyip:", config.DenyIP, "aclfile:", config.ACLFile)
 		log.Println("tcp:", config.TCP)
 		log.Println("pprof:", config.Pprof)
 
 		// Validate QPP parameters so we can warn about unsafe combinations early.
 		if config.QPP {
 			suggestions, err := std.ValidateQPPParams(config.QPPCount, config.Key)
-			if err != nil {
-				log.Fatal(err)
-			}
+			checkError(err)
 			for _, msg := range suggestions {
 				color.Red(msg)
 			}
@@ -378,7 +666,7 @@ func main() {
 
 		// Guard against negotiating unsupported smux protocol versions.
 		if config.SmuxVer > maxSmuxVer {
-			log.Fatal("unsupported smux version:", config.SmuxVer)
+			checkError(errors.Errorf("unsupported smux version: %d", config.SmuxVer))
 		}
 
 		// Derive the shared encryption key and prepare the block cipher.
@@ -388,6 +676,8 @@ func main() {
 		block, effectiveCrypt := std.SelectBlockCrypt(config.Crypt, pass)
 		config.Crypt = effectiveCrypt
 
+		std.SetDrainTimeout(time.Duration(config.Drain) * time.Second)
+
 		// Continuously export SNMP counters when requested.
 		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
 
@@ -400,18 +690,15 @@ func main() {
 			}()
 		}
 
-		// Launch the session scavenger only when auto-expiration is enabled.
+		// The scavenger closes expired sessions, and the ones moved off a
+		// remote after failing back to a preferred one.
 		chScavenger := make(chan timedSession, 128)
-		if config.AutoExpire > 0 {
-			go scavenger(chScavenger, &config)
-		}
+		go scavenger(chScavenger, &config)
 
 		// Accept TCP/UNIX clients and multiplex them across the UDP tunnels.
-		numconn := uint16(config.Conn)
-		muxes := make([]timedSession, numconn)
-		// rr tracks which pre-established session should carry the next client so
-		// short-lived TCP dials do not hammer the same UDP tunnel.
-		rr := uint16(0)
+		selector, err := newSessionSelector(config.Select)
+		checkError(err)
+		pool := newSessionPool(&config, block, selector, chScavenger)
 
 		// Instantiate a shared QPP pad if the feature is enabled.
 		var _Q_ *qpp.QuantumPermutationPad
@@ -419,47 +706,134 @@ func main() {
 			_Q_ = qpp.NewQPP([]byte(config.Key), uint16(config.QPPCount))
 		}
 
-		// Main accept loop: assign each inbound client to a rotating smux session and
-		// refresh sessions on demand so parallel TCP streams keep flowing smoothly.
-		for {
-			p1, err := listener.Accept()
-			if err != nil {
-				log.Fatalf("%+v", err)
+		// In stdio mode a single stream is piped to stdin/stdout instead.
+		if config.Stdio {
+			if err := runStdio(&config, block, _Q_, os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "kcptun: %v\n", err)
+				os.Exit(1)
 			}
-			idx := rr % numconn
-
-			// Refresh the selected session if it is missing, closed, or past its TTL.
-			if muxes[idx].session == nil || muxes[idx].session.IsClosed() ||
-				(config.AutoExpire > 0 && time.Now().After(muxes[idx].expiryDate)) {
-				muxes[idx].session = waitConn(&config, block)
-				muxes[idx].expiryDate = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-				if config.AutoExpire > 0 { // only track TTL when auto-expiration is enabled
-					chScavenger <- muxes[idx]
-				}
+			return nil
+		}
+
+		// Decide how each accepted client names its destination: through a
+		// SOCKS5 or HTTP proxy request, the firewall, or the -target of the
+		// last reload, if any.
+		var handshake handshakeFunc
+		switch {
+		case config.TProxy != "":
+			handshake = transparentHandshake(config.TProxy, listener.Addr())
+		case config.SOCKS5:
+			handshake = socks5Handshake(config.SOCKS5User, config.SOCKS5Pass)
+		case config.HTTP:
+			handshake = httpHandshake()
+		default:
+			handshake = liveTarget(&running)
+		}
+		liveQuiet := func() bool { return running.Load().Quiet }
+		if config.SendSource {
+			handshake = withSource(handshake)
+		}
+
+		// Learn the real client addresses from a load balancer in front.
+		var pp *proxyAcceptor
+		if config.ProxyProtocol {
+			var err error
+			pp, err = newProxyAcceptor(config.ProxyTrusted)
+			checkError(err)
+		}
+
+		// Admit local clients by their IP.
+		acl, err := std.NewACL(config.AllowIP, config.DenyIP, config.ACLFile)
+		checkError(err)
+
+		// Every forward rule gets its own listener on the shared sessions.
+		for _, rule := range config.Forwards {
+			quiet, closeWait := liveQuiet, config.CloseWait
+			if rule.Quiet != nil {
+				ruleQuiet := *rule.Quiet
+				quiet = func() bool { return ruleQuiet }
+			}
+			if rule.CloseWait != nil {
+				closeWait = *rule.CloseWait
+			}
+			resume := config.Resume
+			if rule.Resume != nil {
+				resume = *rule.Resume
 			}
 
-			// Serve the accepted client in its own goroutine to keep the accept loop responsive.
-			go handleClient(_Q_, []byte(config.Key), muxes[idx].session, p1, config.Quiet, config.CloseWait)
-			rr++
+			l, err := listenLocal(rule.Listen)
+			checkError(err)
+			if rule.Comp != nil && !*rule.Comp && !config.NoComp {
+				log.Println("forward:", rule.Listen, "comp: false has no effect, the sessions compress every stream unless -nocomp")
+			}
+			comp := rule.compStreams(config.NoComp)
+			log.Println("listening on:", l.Addr(), "forward to:", rule.Target, "quiet:", quiet(), "closewait:", closeWait, "comp:", comp || !config.NoComp, "redundant:", rule.Redundant, "resume:", resume)
+			handshake := fixedTarget(targetHeader(rule.Target, comp))
+			if config.SendSource {
+				handshake = withSource(handshake)
+			}
+			rs := newResumer(pool, time.Duration(resume)*time.Second, quiet)
+			go serveForward(l, pool, pp, acl, handshake, rule.Redundant, rs, _Q_, []byte(config.Key), quiet, closeWait)
 		}
+
+		// Serve reverse tunnels on every session of the pool.
+		if len(config.Reverse) > 0 {
+			rules, err := std.ParseReverseRules(config.Reverse)
+			checkError(err)
+			rc := &reverseClient{
+				rules:     rules,
+				_Q_:       _Q_,
+				seed:      []byte(config.Key),
+				quiet:     config.Quiet,
+				closeWait: config.CloseWait,
+			}
+			pool.onSession = rc.serve
+		}
+
+		// Bring all sessions up in parallel, the listeners wait for them.
+		pool.start()
+
+		// Relay local UDP datagrams alongside the stream listener.
+		if config.UDP != "" {
+			addr, err := net.ResolveUDPAddr("udp", config.UDP)
+			checkError(err)
+			conn, err := net.ListenUDP("udp", addr)
+			checkError(err)
+			log.Println("listening on:", conn.LocalAddr(), "(udp)")
+
+			go serveUDP(conn, pool, acl, &running, _Q_, []byte(config.Key), time.Duration(config.UDPTimeout)*time.Second)
+		}
+
+		// Main accept loop, the other listeners run in their own goroutines.
+		if listener != nil {
+			rs := newResumer(pool, time.Duration(config.Resume)*time.Second, liveQuiet)
+			serveForward(listener, pool, pp, acl, handshake, config.Redundant, rs, _Q_, []byte(config.Key), liveQuiet, config.CloseWait)
+		}
+		select {}
 	}
 	myApp.Run(os.Args)
 }
 
-// createConn establishes a fresh KCP connection with all tunables applied and
-// then upgrades it into an smux session ready for multiplexing.
-func createConn(config *Config, block kcp.BlockCrypt) (*smux.Session, error) {
-	kcpconn, err := dial(config, block)
+// createConn establishes a fresh KCP connection over path to one of the
+// remotes and then upgrades it into an smux session ready for multiplexing.
+func createConn(config *Config, block kcp.BlockCrypt, path string) (timedSession, error) {
+	kcpconn, r, err := dial(config, block, path)
+	if err != nil {
+		return timedSession{}, errors.Wrap(err, "dial()")
+	}
+	session, err := newSmuxSession(config, kcpconn)
 	if err != nil {
-		return nil, errors.Wrap(err, "dial()")
+		return timedSession{}, err
 	}
+	return timedSession{session: session, conn: kcpconn, remote: r}, nil
+}
+
+// newSmuxSession applies all tunables to kcpconn and then upgrades it into
+// an smux session.
+func newSmuxSession(config *Config, kcpconn *kcp.UDPSession) (*smux.Session, error) {
 	kcpconn.SetStreamMode(true)
 	kcpconn.SetWriteDelay(false)
-	kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-	kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-	kcpconn.SetMtu(config.MTU)
-	kcpconn.SetACKNoDelay(config.AckNodelay)
-	kcpconn.SetRateLimit(uint32(config.RateLimit))
+	untrackKCP := config.TuneKCP(kcpconn)
 
 	if err := kcpconn.SetDSCP(config.DSCP); err != nil {
 		log.Println("SetDSCP:", err)
@@ -479,6 +853,7 @@ func createConn(config *Config, block kcp.BlockCrypt) (*smux.Session, error) {
 		config.KeepAlive,
 	)
 	if err != nil {
+		untrackKCP()
 		kcpconn.Close()
 		return nil, errors.Wrap(err, "BuildSmuxConfig()")
 	}
@@ -490,26 +865,90 @@ func createConn(config *Config, block kcp.BlockCrypt) (*smux.Session, error) {
 		session, err = smux.Client(std.NewCompStream(kcpconn), smuxConfig)
 	}
 	if err != nil {
+		untrackKCP()
 		return nil, errors.Wrap(err, "createConn()")
 	}
+
+	// Let a shutdown close the session once its streams are done, and
+	// reloads tune it meanwhile.
+	untrack := std.TrackSession(session)
+	go func() {
+		<-session.CloseChan()
+		untrack()
+		untrackKCP()
+	}()
 	return session, nil
 }
 
-// waitConn keeps dialing until a healthy smux session becomes available.
-func waitConn(config *Config, block kcp.BlockCrypt) *smux.Session {
+// waitConn keeps dialing over path, spaced out by bo, until a smux session
+// is created.
+func waitConn(config *Config, block kcp.BlockCrypt, path string, bo *backoff) timedSession {
 	for {
-		session, err := createConn(config, block)
+		reconnectAttempts.Inc()
+		ts, err := createConn(config, block, path)
 		if err == nil {
-			return session
+			return ts
 		}
-		log.Println("re-connecting:", err)
-		time.Sleep(time.Second)
+		bo.fail(err)
+	}
+}
+
+// handshakeFunc negotiates the destination of an accepted client before a
+// stream is opened for it. The returned replyFunc, if any, reports the
+// server's answer back to the client; p2 is the stream side of the pipe and is
+// only usable when code is std.ReplyOK.
+type handshakeFunc func(p1 net.Conn) (*std.Header, replyFunc, error)
+type replyFunc func(p2 io.Writer, code byte) error
+
+// fixedTarget requests the same destination for every stream.
+func fixedTarget(hdr *std.Header) handshakeFunc {
+	return func(net.Conn) (*std.Header, replyFunc, error) {
+		return hdr, nil, nil
+	}
+}
+
+// liveTarget requests the -target of the running config, which reloads
+// change, or the server's default target without one.
+func liveTarget(running *atomic.Pointer[Config]) handshakeFunc {
+	return func(net.Conn) (*std.Header, replyFunc, error) {
+		if target := running.Load().Target; target != "" {
+			return targetHeader(target, false), nil, nil
+		}
+		return nil, nil, nil
+	}
+}
+
+// withSource adds the addresses of the accepted client to the header
+// requested by handshake, so the server can pass them on to the target with
+// PROXY protocol. A nil handshake requests the server's default target.
+func withSource(handshake handshakeFunc) handshakeFunc {
+	return func(p1 net.Conn) (*std.Header, replyFunc, error) {
+		hdr := new(std.Header)
+		var reply replyFunc
+		if handshake != nil {
+			h, r, err := handshake(p1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if h != nil { // copied, fixedTarget shares its header between clients
+				*hdr = *h
+			}
+			reply = r
+		}
+		if _, ok := p1.RemoteAddr().(*net.TCPAddr); ok {
+			hdr.Src, hdr.Dst = p1.RemoteAddr().String(), p1.LocalAddr().String()
+		}
+		return hdr, reply, nil
 	}
 }
 
 // handleClient tunnels a single accepted TCP/UNIX client through an smux
 // stream and optionally wraps the stream in QPP for additional obfuscation.
-func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Session, p1 net.Conn, quiet bool, closeWait int) {
+// A non-nil handshake asks the server to forward the stream to the
+// destination it returns. Given several sessions, the stream is made
+// redundant with a leg on each of them, see std.DupConn. With rs set, the
+// stream is resumable and moves to another session when its own dies.
+func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, sessions []*smux.Session, p1 net.Conn, handshake handshakeFunc, rs *resumer, quiet bool, closeWait int) {
 	logln := func(v ...any) {
 		if !quiet {
 			log.Println(v...)
@@ -518,24 +957,116 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Ses
 
 	// Transport layer: accept the inbound socket and clean it up on exit.
 	defer p1.Close()
-	p2, err := session.OpenStream()
-	if err != nil {
-		logln(err)
+
+	// Learn the destination from the client before touching the tunnel.
+	var hdr *std.Header
+	var reply replyFunc
+	if handshake != nil {
+		p1.SetDeadline(time.Now().Add(handshakeTimeout))
+		var err error
+		if hdr, reply, err = handshake(p1); err != nil {
+			logln("handshake:", err, "in:", p1.RemoteAddr())
+			return
+		}
+		p1.SetDeadline(time.Time{})
+	}
+
+	var legs []*smux.Stream
+	for _, session := range sessions {
+		p2, err := session.OpenStream()
+		if err != nil {
+			logln(err)
+			continue
+		}
+		defer p2.Close()
+		legs = append(legs, p2)
+	}
+	if len(legs) == 0 {
+		if reply != nil {
+			reply(nil, std.ReplyFailure)
+		}
 		return
 	}
-	defer p2.Close()
 
-	streamID := fmt.Sprintf("%v(%d)", p2.RemoteAddr(), p2.ID())
-	logln("stream opened", "in:", p1.RemoteAddr(), "out:", streamID)
-	defer logln("stream closed", "in:", p1.RemoteAddr(), "out:", streamID)
+	// The legs of a redundant stream name the same group, the server joins
+	// them into one connection to the target.
+	if len(legs) > 1 {
+		group := std.Header{}
+		if hdr != nil {
+			group = *hdr // copied, fixedTarget shares its header between clients
+		}
+		group.Group, group.Legs = newGroupID(), len(legs)
+		hdr = &group
+	}
+
+	// A resumable stream is named by an id, to find it again from a new leg.
+	if rs != nil {
+		resumable := std.Header{}
+		if hdr != nil {
+			resumable = *hdr
+		}
+		resumable.Resume = newGroupID()
+		hdr = &resumable
+	}
+
+	streamID := fmt.Sprintf("%v(%d)", legs[0].RemoteAddr(), legs[0].ID())
+
+	var code byte
+	var err error
+	if hdr != nil {
+		// The header and its reply travel before QPP wraps the stream.
+		var ok []*smux.Stream
+		if ok, code, err = openLegs(legs, hdr); err == nil {
+			legs = ok
+		}
+	}
+
+	// Compress the stream below QPP when the server is asked to, as done
+	// for whole sessions, and optionally wrap it in QPP obfuscation.
+	wrap := func(p2 *smux.Stream) io.ReadWriteCloser {
+		var s2 io.ReadWriteCloser = p2
+		if hdr != nil && hdr.Comp {
+			s2 = std.NewCompStream(p2)
+		}
+		if _Q_ != nil {
+			s2 = std.NewQPPPort(s2, _Q_, seed)
+		}
+		return s2
+	}
 
-	var s1, s2 io.ReadWriteCloser = p1, p2
-	// Optionally wrap the smux side with QPP obfuscation.
-	if _Q_ != nil {
-		// Replace the smux side with a QPP-wrapped port.
-		s2 = std.NewQPPPort(p2, _Q_, seed)
+	var s1, s2 io.ReadWriteCloser = p1, wrap(legs[0])
+	if len(legs) > 1 {
+		wrapped := make([]io.ReadWriteCloser, len(legs))
+		for i, leg := range legs {
+			wrapped[i] = wrap(leg)
+		}
+		s2 = std.NewDupConn(wrapped)
+		streamID = fmt.Sprintf("%v legs:%d", streamID, len(legs))
+	}
+	if rs != nil && err == nil {
+		rc := std.NewResumeConn()
+		if err = rc.Attach(s2); err == nil {
+			go rs.keep(rc, hdr, wrap, p1.RemoteAddr(), streamID)
+			s2 = rc
+			defer rc.Close()
+		}
+	}
+
+	if hdr != nil {
+		if reply != nil {
+			if rerr := reply(s2, code); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		if err != nil {
+			logln("target:", hdr.Addr, err, "in:", p1.RemoteAddr(), "out:", streamID)
+			return
+		}
 	}
 
+	logln("stream opened", "in:", p1.RemoteAddr(), "out:", streamID)
+	defer logln("stream closed", "in:", p1.RemoteAddr(), "out:", streamID)
+
 	// Begin piping data bidirectionally between the socket and the smux stream.
 	err1, err2 := std.Pipe(s1, s2, closeWait)
 
@@ -552,13 +1083,20 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Ses
 func checkError(err error) {
 	if err != nil {
 		log.Printf("%+v\n", err)
+		fmt.Fprintf(fatalOutput, "kcptun: %v\n", err)
 		os.Exit(-1)
 	}
 }
 
+// fatalOutput also receives the errors of checkError, stderr in stdio mode
+// where the log is discarded.
+var fatalOutput io.Writer = io.Discard
+
 // timedSession annotates a smux session with its expiration deadline.
 type timedSession struct {
 	session    *smux.Session
+	conn       *kcp.UDPSession // the KCP connection carrying session
+	remote     *remote         // the server conn is connected to
 	expiryDate time.Time
 }
 
@@ -573,8 +1111,8 @@ func scavenger(ch chan timedSession, config *Config) {
 		select {
 		case item := <-ch:
 			sessionList = append(sessionList, timedSession{
-				item.session,
-				item.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)})
+				session:    item.session,
+				expiryDate: item.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)})
 		case <-ticker.C:
 			// Reuse slice capacity to avoid allocation
 			newList := sessionList[:0]
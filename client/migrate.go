@@ -0,0 +1,86 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+const (
+	// addrCheckInterval is how often a migrating session checks whether
+	// its local address changed.
+	addrCheckInterval = time.Second
+
+	// announceInterval is how often a migrating session announces itself
+	// anyway, which also covers NAT mappings changing behind its back.
+	announceInterval = 10 * time.Second
+)
+
+// keepAnnounced announces conn to the server on a regular basis, and right
+// away when the local address used to reach remote changes, until conn is
+// closed along with its session.
+func keepAnnounced(conn *std.AnnounceConn, remote *net.UDPAddr, quiet bool) {
+	ticker := time.NewTicker(addrCheckInterval)
+	defer ticker.Stop()
+
+	local := routeAddr(remote)
+	lastAnnounce := time.Now()
+	for ticks := 1; ; ticks++ {
+		select {
+		case <-ticker.C:
+		case <-conn.Done():
+			return
+		}
+
+		// The first tick repeats the initial announcement, in case it got lost.
+		announce := ticks == 1 || time.Since(lastAnnounce) >= announceInterval
+		if addr := routeAddr(remote); addr != nil && !addr.Equal(local) {
+			if !quiet {
+				log.Println("local address changed:", local, "->", addr, "remote:", remote)
+			}
+			local, announce = addr, true
+		}
+		if announce {
+			// Fails while the network is down, the next tick retries.
+			if err := conn.Announce(); err == nil {
+				lastAnnounce = time.Now()
+			}
+		}
+	}
+}
+
+// routeAddr returns the local address the system currently sends packets to
+// remote from, or nil when it has no route.
+func routeAddr(remote *net.UDPAddr) net.IP {
+	// Connecting a UDP socket only looks up the route, nothing is sent.
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
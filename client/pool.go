@@ -0,0 +1,260 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// sessionWaitTimeout bounds how long a client waits for a session to come up
+// when none is healthy.
+const sessionWaitTimeout = 30 * time.Second
+
+var (
+	errNoSession = errors.New("no session available")
+	errPoolBusy  = errors.New("too many clients waiting for a session")
+)
+
+// sessionPool holds the config.Conn smux sessions shared by every local
+// listener and hands them out as chosen by its selector. Each slot is kept
+// up by its own goroutine, so a dead session never blocks the clients that
+// could use the others.
+type sessionPool struct {
+	config      *Config
+	block       kcp.BlockCrypt
+	selector    sessionSelector
+	chScavenger chan timedSession
+
+	mu      sync.Mutex
+	muxes   []timedSession
+	ready   chan struct{} // closed and replaced whenever a session comes up
+	waiting int           // clients blocked in get
+
+	// onSession, if set, is started in its own goroutine for every session
+	// the pool establishes, together with the session's slot.
+	onSession func(idx int, session *smux.Session)
+}
+
+// newSessionPool creates an empty pool; sessions are dialed by start.
+func newSessionPool(config *Config, block kcp.BlockCrypt, selector sessionSelector, chScavenger chan timedSession) *sessionPool {
+	return &sessionPool{
+		config:      config,
+		block:       block,
+		selector:    selector,
+		chScavenger: chScavenger,
+		muxes:       make([]timedSession, config.Conn),
+		ready:       make(chan struct{}),
+	}
+}
+
+// start dials every slot in parallel and keeps redialing each of them in the
+// background once its session dies or expires.
+func (p *sessionPool) start() {
+	for idx := range p.muxes {
+		go p.keep(idx)
+	}
+}
+
+// keep maintains the session of slot idx for the lifetime of the process,
+// sending it through one of config.Bind in turn when set.
+//
+// Over UDP a dial succeeds even when the server is down, which only shows as
+// the session closing once smux saw nothing from the server for its
+// keepalive timeout. Such short-lived sessions count as failed attempts, and
+// sessions living past sessionProvenAfter prove their remote is working.
+func (p *sessionPool) keep(idx int) {
+	var path string
+	if len(p.config.Bind) > 0 {
+		path = p.config.Bind[idx%len(p.config.Bind)]
+	}
+
+	bo := newBackoff(p.config)
+	for {
+		ts := waitConn(p.config, p.block, path, bo)
+		session := ts.session
+		established := time.Now()
+		if p.config.AutoExpire > 0 { // only track TTL when auto-expiration is enabled
+			ts.expiryDate = time.Now().Add(time.Duration(p.config.AutoExpire) * time.Second)
+			p.chScavenger <- ts
+		}
+
+		p.set(idx, ts)
+		if p.onSession != nil {
+			go p.onSession(idx, session)
+		}
+
+		// An expired session is left to the scavenger, which closes it once
+		// its streams had time to finish.
+		var expired <-chan time.Time
+		if p.config.AutoExpire > 0 {
+			expired = time.After(time.Until(ts.expiryDate))
+		}
+		proven := time.After(sessionProvenAfter)
+	wait:
+		for {
+			select {
+			case <-session.CloseChan():
+				break wait
+			case <-expired:
+				break wait
+			case <-proven:
+				proven = nil
+				remotes.succeed(ts.remote)
+			case <-remotes.recoveredCh():
+				// Move back to a preferred remote once it recovered, the
+				// scavenger retires this session as if it had expired.
+				if remotes.better(ts.remote) {
+					if p.config.AutoExpire <= 0 {
+						ts.expiryDate = time.Now()
+						p.chScavenger <- ts
+					}
+					break wait
+				}
+			}
+		}
+		p.set(idx, timedSession{})
+
+		if session.IsClosed() && proven != nil {
+			remotes.fail(ts.remote)
+			bo.fail(errors.Errorf("session closed after %v", time.Since(established).Round(time.Second)))
+		} else {
+			bo.reset()
+		}
+	}
+}
+
+// set stores ts in slot idx and wakes up the clients waiting for a session.
+func (p *sessionPool) set(idx int, ts timedSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.muxes[idx] = ts
+	if ts.session != nil {
+		close(p.ready)
+		p.ready = make(chan struct{})
+	}
+}
+
+// get returns the healthy session the selector picks for client. When none
+// is healthy the client waits for one to come up, as long as fewer than
+// config.WaitQueue clients are already waiting.
+func (p *sessionPool) get(client net.Addr) (*smux.Session, error) {
+	var timeout <-chan time.Time
+	for {
+		p.mu.Lock()
+		if idx := p.selector.pick(client, p.stats()); idx >= 0 {
+			session := p.muxes[idx].session
+			p.mu.Unlock()
+			return session, nil
+		}
+
+		if timeout == nil {
+			if p.waiting >= p.config.WaitQueue {
+				p.mu.Unlock()
+				return nil, errPoolBusy
+			}
+			p.waiting++
+			defer func() {
+				p.mu.Lock()
+				p.waiting--
+				p.mu.Unlock()
+			}()
+
+			timer := time.NewTimer(sessionWaitTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		ready := p.ready
+		p.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-timeout:
+			return nil, errNoSession
+		}
+	}
+}
+
+// getN returns the session get picks for client followed by up to n-1
+// other healthy sessions, the legs of a redundant stream. Sessions sent
+// through another of config.Bind than the first come before those sharing
+// its path, so the legs fail independently where possible.
+func (p *sessionPool) getN(client net.Addr, n int) ([]*smux.Session, error) {
+	first, err := p.get(client)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*smux.Session{first}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path := func(idx int) int {
+		if len(p.config.Bind) == 0 {
+			return 0
+		}
+		return idx % len(p.config.Bind)
+	}
+	firstPath := -1
+	for i, m := range p.muxes {
+		if m.session == first {
+			firstPath = path(i)
+		}
+	}
+
+	slots := p.stats()
+	for _, samePath := range []bool{false, true} {
+		for i, slot := range slots {
+			if len(sessions) >= n {
+				return sessions, nil
+			}
+			if slot.alive && p.muxes[i].session != first && (path(i) == firstPath) == samePath {
+				sessions = append(sessions, p.muxes[i].session)
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// stats snapshots the health and load of every slot for the selector.
+// p.mu must be held.
+func (p *sessionPool) stats() []sessionStats {
+	slots := make([]sessionStats, len(p.muxes))
+	now := time.Now()
+	for i, m := range p.muxes {
+		if m.session == nil || m.session.IsClosed() ||
+			(p.config.AutoExpire > 0 && now.After(m.expiryDate)) {
+			continue
+		}
+		slots[i] = sessionStats{alive: true, streams: m.session.NumStreams()}
+		if m.conn != nil {
+			slots[i].srtt = m.conn.GetSRTT()
+			slots[i].rttvar = m.conn.GetSRTTVar()
+		}
+	}
+	return slots
+}
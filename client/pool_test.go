@@ -0,0 +1,127 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcptun/std/stdtest"
+	"github.com/xtaci/smux"
+)
+
+func TestSessionPoolWaitQueue(t *testing.T) {
+	config := &Config{Conn: 2, WaitQueue: 1}
+	pool := newSessionPool(config, nil, new(roundRobinSelector), nil)
+
+	type result struct {
+		session *smux.Session
+		err     error
+	}
+	ch := make(chan result)
+	go func() {
+		session, err := pool.get(nil)
+		ch <- result{session, err}
+	}()
+
+	// Wait for the first client to queue up, the next one finds it full.
+	for deadline := time.Now().Add(time.Second); ; {
+		pool.mu.Lock()
+		waiting := pool.waiting
+		pool.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first client never started waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := pool.get(nil); err != errPoolBusy {
+		t.Fatalf("got %v with a full wait queue, want errPoolBusy", err)
+	}
+
+	session := stdtest.NewSession(t)
+	pool.set(1, timedSession{session: session})
+	select {
+	case r := <-ch:
+		if r.err != nil || r.session != session {
+			t.Fatalf("waiting client got %v, %v", r.session, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting client not woken up by a new session")
+	}
+
+	// Healthy sessions are handed out without waiting, dead ones skipped.
+	if got, err := pool.get(nil); err != nil || got != session {
+		t.Fatalf("got %v, %v, want the only healthy session", got, err)
+	}
+	dead := stdtest.NewSession(t)
+	dead.Close()
+	pool.set(0, timedSession{session: dead})
+	for i := 0; i < 2; i++ {
+		if got, _ := pool.get(nil); got != session {
+			t.Fatal("closed session handed out")
+		}
+	}
+}
+
+func TestSessionPoolGetN(t *testing.T) {
+	config := &Config{Conn: 4, Bind: []string{"eth0", "eth1"}}
+	pool := newSessionPool(config, nil, new(roundRobinSelector), nil)
+	var sessions []*smux.Session
+	for i := 0; i < config.Conn; i++ {
+		sessions = append(sessions, stdtest.NewSession(t))
+		pool.set(i, timedSession{session: sessions[i]})
+	}
+
+	// Slots 0 and 2 go through eth0, 1 and 3 through eth1.
+	for i := 0; i < config.Conn; i++ {
+		legs, err := pool.getN(nil, 2)
+		if err != nil {
+			t.Fatalf("getN returned error: %v", err)
+		}
+		if len(legs) != 2 || legs[0] == legs[1] {
+			t.Fatalf("got %d legs, want 2 distinct ones", len(legs))
+		}
+		var idx [2]int
+		for j, leg := range legs {
+			for k, s := range sessions {
+				if s == leg {
+					idx[j] = k
+				}
+			}
+		}
+		if idx[0]%2 == idx[1]%2 {
+			t.Fatalf("legs from slots %d and %d share a path", idx[0], idx[1])
+		}
+	}
+
+	// With a single healthy session the stream has a single leg.
+	for i := 1; i < config.Conn; i++ {
+		pool.set(i, timedSession{})
+	}
+	if legs, err := pool.getN(nil, 2); err != nil || len(legs) != 1 || legs[0] != sessions[0] {
+		t.Fatalf("got %v, %v, want the only healthy session", legs, err)
+	}
+}
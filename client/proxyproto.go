@@ -0,0 +1,101 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// proxyAcceptor reads the PROXY protocol header of the connections handed
+// over by a load balancer in front of the client.
+type proxyAcceptor struct {
+	trusted []netip.Prefix
+}
+
+// newProxyAcceptor accepts PROXY protocol headers only from the given
+// networks, written as CIDRs or single IPs as for the ACL.
+func newProxyAcceptor(trusted []string) (*proxyAcceptor, error) {
+	prefixes, err := std.ParsePrefixes(trusted)
+	if err != nil {
+		return nil, errors.WithMessage(err, "proxytrusted")
+	}
+	return &proxyAcceptor{trusted: prefixes}, nil
+}
+
+// isTrusted reports whether addr may send PROXY protocol headers. Peers of
+// unix sockets are local and guarded by file permissions.
+func (a *proxyAcceptor) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, p := range a.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept reads the PROXY protocol header of conn, which must come from a
+// trusted peer, and returns a connection reporting the announced addresses.
+func (a *proxyAcceptor) accept(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	src, dst, err := std.ReadProxyHeader(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy protocol")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// LOCAL and UNKNOWN headers keep the addresses of the connection.
+	pc := &proxiedConn{Conn: conn, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if src.IsValid() && dst.IsValid() {
+		pc.remote, pc.local = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	}
+	return pc, nil
+}
+
+// proxiedConn is a connection relayed by a proxy, reporting the addresses of
+// the original client.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr  { return c.local }
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
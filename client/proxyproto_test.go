@@ -0,0 +1,86 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestProxyAcceptorTrusted(t *testing.T) {
+	pp, err := newProxyAcceptor([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::ffff:172.16.0.0/108"})
+	if err != nil {
+		t.Fatalf("newProxyAcceptor returned error: %v", err)
+	}
+	for _, tc := range []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.11")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("172.16.5.5")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, true},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, true},
+	} {
+		if got := pp.isTrusted(tc.addr); got != tc.want {
+			t.Fatalf("%v: got %v want %v", tc.addr, got, tc.want)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := newProxyAcceptor([]string{entry}); err == nil {
+			t.Fatalf("expected error for %q", entry)
+		}
+	}
+}
+
+func TestProxyAcceptorAccept(t *testing.T) {
+	pp, err := newProxyAcceptor([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("newProxyAcceptor returned error: %v", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	src, dst := netip.MustParseAddrPort("192.0.2.1:5000"), netip.MustParseAddrPort("198.51.100.1:443")
+	go func() {
+		hdr, _ := std.MarshalProxyHeader(std.ProxyV2, src, dst)
+		c2.Write(append(hdr, "hello"...))
+	}()
+
+	conn, err := pp.accept(c1)
+	if err != nil {
+		t.Fatalf("accept returned error: %v", err)
+	}
+	if conn.RemoteAddr().String() != src.String() || conn.LocalAddr().String() != dst.String() {
+		t.Fatalf("unexpected addresses: %v %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	expectBytes(t, conn, []byte("hello"))
+}
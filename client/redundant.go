@@ -0,0 +1,109 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"slices"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+// redundantLegs is the number of sessions a redundant stream is sent over.
+const redundantLegs = 2
+
+// legReplyWait bounds how long the other legs of a redundant stream may take
+// to be answered once the first leg was.
+const legReplyWait = 5 * time.Second
+
+// newGroupID returns a random id naming the legs of a redundant stream.
+func newGroupID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return string(id)
+}
+
+// legReply is the answer of the server to the header of one leg.
+type legReply struct {
+	leg  *smux.Stream
+	code byte
+	err  error
+}
+
+// openLegs sends hdr on every leg and waits for the answers. Legs which fail
+// or are not answered within legReplyWait after the first successful one are
+// closed, the others are returned in the order they were answered. Without
+// any successful leg, the code and error of the first failure are returned.
+func openLegs(legs []*smux.Stream, hdr *std.Header) ([]*smux.Stream, byte, error) {
+	ch := make(chan legReply, len(legs))
+	for _, leg := range legs {
+		go func(leg *smux.Stream) {
+			code := std.ReplyFailure
+			err := std.WriteHeader(leg, hdr)
+			if err == nil {
+				code, err = std.ReadReply(leg)
+			}
+			ch <- legReply{leg, code, err}
+		}(leg)
+	}
+
+	var ok []*smux.Stream
+	first := legReply{code: std.ReplyOK}
+	var timeout <-chan time.Time
+	for pending := len(legs); pending > 0; pending-- {
+		var r legReply
+		select {
+		case r = <-ch:
+		case <-timeout:
+			// Closing the late legs unblocks their goroutines.
+			for _, leg := range legs {
+				if !slices.Contains(ok, leg) {
+					leg.Close()
+				}
+			}
+			for ; pending > 0; pending-- {
+				<-ch
+			}
+			return ok, std.ReplyOK, nil
+		}
+
+		if r.err != nil {
+			r.leg.Close()
+			if first.err == nil {
+				first = r
+			}
+			continue
+		}
+		ok = append(ok, r.leg)
+		if timeout == nil {
+			timeout = time.After(legReplyWait)
+		}
+	}
+
+	if len(ok) == 0 {
+		return nil, first.code, first.err
+	}
+	return ok, std.ReplyOK, nil
+}
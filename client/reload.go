@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// liveFields are the config fields a reload applies to the running client,
+// changing any other one needs a restart.
+var liveFields = append([]string{"target", "quiet", "log"}, std.LiveKCPFields...)
+
+// reloader re-reads the config file on SIGHUP. New streams go to the new
+// target, and the KCP settings change on the running sessions too.
+type reloader struct {
+	path    string
+	flags   Config                  // the command line, which the file overrides
+	loaded  Config                  // the config as last read, before the values derived from it
+	running *atomic.Pointer[Config] // the config new streams follow
+}
+
+// reload applies the config file if only liveFields changed in it.
+func (r *reloader) reload() error {
+	var next Config
+	if err := std.ReadConfig(&next, &r.flags, r.path); err != nil {
+		return err
+	}
+	if next.RateLimit < 0 {
+		next.RateLimit = 0
+	}
+	next.ApplyMode()
+
+	var fixed []string
+	for _, name := range std.ChangedFields(&r.loaded, &next) {
+		if !slices.Contains(liveFields, name) {
+			fixed = append(fixed, name)
+		}
+	}
+	if len(fixed) > 0 {
+		return errors.Errorf("%v cannot change without a restart", strings.Join(fixed, ", "))
+	}
+
+	if next.Log != r.loaded.Log {
+		if err := std.OpenLog(next.Log); err != nil {
+			return err
+		}
+	}
+	running := *r.running.Load()
+	std.CopyFields(&running, &next, liveFields)
+	r.running.Store(&running)
+	n := std.RetuneKCP(&running.BaseConfig)
+	r.loaded = next
+
+	log.Println("reload: target:", running.Target, "quiet:", running.Quiet, "log:", running.Log)
+	log.Println("reload: nodelay parameters:", running.NoDelay, running.Interval, running.Resend, running.NoCongestion,
+		"sndwnd:", running.SndWnd, "rcvwnd:", running.RcvWnd, "mtu:", running.MTU, "acknodelay:", running.AckNodelay,
+		"ratelimit:", running.RateLimit, "applied to", n, "sessions")
+	return nil
+}
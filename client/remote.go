@@ -0,0 +1,217 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// remoteMaxFailures is the number of consecutive failures after which a
+	// remote is marked down.
+	remoteMaxFailures = 3
+	// remoteProbeInterval is how often a remote that is down is probed.
+	remoteProbeInterval = 30 * time.Second
+)
+
+// sessionProvenAfter is how long a session must stay open to prove that its
+// server answers: smux closes the sessions that heard nothing for its
+// keepalive timeout, a margin keeps clear of that check.
+var sessionProvenAfter = smux.DefaultConfig().KeepAliveTimeout + 5*time.Second
+
+// remote is one server the client can dial, written in remoteaddr as
+// "host:port[-port][;priority=N][;weight=N]". Remotes with the lowest
+// priority are preferred, and share the sessions by weight.
+type remote struct {
+	addr     string // host and port range as configured
+	mp       *std.MultiPort
+	priority int
+	weight   int
+
+	// guarded by remoteSet.mu
+	failures int
+	down     bool
+}
+
+// remoteSet tracks the health of the configured remotes.
+type remoteSet struct {
+	remotes []*remote
+
+	mu        sync.Mutex
+	recovered chan struct{} // closed and replaced whenever a remote comes back
+	probe     func(r *remote) error
+}
+
+// parseRemotes parses the comma separated remotes of remoteaddr.
+func parseRemotes(s string) (*remoteSet, error) {
+	rs := &remoteSet{recovered: make(chan struct{})}
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ";")
+		mp, err := std.ParseMultiPort(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "remoteaddr %q", entry)
+		}
+
+		r := &remote{addr: fields[0], mp: mp, priority: 1, weight: 1}
+		for _, opt := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, errors.Errorf("remoteaddr %q: %v must be a positive number", entry, key)
+			}
+			switch key {
+			case "priority":
+				r.priority = n
+			case "weight":
+				r.weight = n
+			default:
+				return nil, errors.Errorf("remoteaddr %q: unknown option %q", entry, key)
+			}
+		}
+		rs.remotes = append(rs.remotes, r)
+	}
+	return rs, nil
+}
+
+// pick chooses the remote for a new session: one of the healthy remotes with
+// the lowest priority, at random by weight. When every remote is down the
+// preferred ones are tried anyway.
+func (rs *remoteSet) pick() *remote {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	candidates := rs.preferred(false)
+	if len(candidates) == 0 {
+		candidates = rs.preferred(true)
+	}
+
+	total := 0
+	for _, r := range candidates {
+		total += r.weight
+	}
+	n := rand.IntN(total)
+	for _, r := range candidates {
+		if n -= r.weight; n < 0 {
+			return r
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// preferred returns the remotes with the lowest priority, skipping the ones
+// that are down unless withDown is set. rs.mu must be held.
+func (rs *remoteSet) preferred(withDown bool) []*remote {
+	var list []*remote
+	for _, r := range rs.remotes {
+		if r.down && !withDown {
+			continue
+		}
+		if len(list) > 0 && r.priority > list[0].priority {
+			continue
+		}
+		if len(list) > 0 && r.priority < list[0].priority {
+			list = list[:0]
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+// better reports whether a healthy remote is preferred over r.
+func (rs *remoteSet) better(r *remote) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	best := rs.preferred(false)
+	return len(best) > 0 && best[0].priority < r.priority
+}
+
+// succeed records that a session to r is working.
+func (rs *remoteSet) succeed(r *remote) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r.failures = 0
+	if r.down {
+		rs.markUp(r)
+	}
+}
+
+// fail records a failed session to r, marking it down after
+// remoteMaxFailures consecutive failures.
+func (rs *remoteSet) fail(r *remote) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r.failures++
+	if r.down || r.failures < remoteMaxFailures || len(rs.remotes) == 1 {
+		return
+	}
+
+	r.down = true
+	log.Println("remote down:", r.addr, "after", r.failures, "failures")
+	if rs.probe != nil {
+		go rs.probeLoop(r)
+	}
+}
+
+// markUp brings r back and wakes up the sessions failed over from it.
+// rs.mu must be held.
+func (rs *remoteSet) markUp(r *remote) {
+	r.down = false
+	log.Println("remote up:", r.addr)
+	close(rs.recovered)
+	rs.recovered = make(chan struct{})
+}
+
+// recoveredCh returns a channel closed once some remote comes back.
+func (rs *remoteSet) recoveredCh() <-chan struct{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.recovered
+}
+
+// probeLoop probes r until it is found working again.
+func (rs *remoteSet) probeLoop(r *remote) {
+	for {
+		time.Sleep(remoteProbeInterval)
+		rs.mu.Lock()
+		down := r.down
+		rs.mu.Unlock()
+		if !down {
+			return
+		}
+		if err := rs.probe(r); err != nil {
+			log.Println("remote probe:", r.addr, err)
+			continue
+		}
+		rs.succeed(r)
+		return
+	}
+}
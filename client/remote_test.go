@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import "testing"
+
+func TestParseRemotes(t *testing.T) {
+	rs, err := parseRemotes("1.1.1.1:4000-4010;priority=1;weight=3, 2.2.2.2:4000;weight=1,[::1]:29900;priority=2")
+	if err != nil {
+		t.Fatalf("parseRemotes returned error: %v", err)
+	}
+	if len(rs.remotes) != 3 {
+		t.Fatalf("expected 3 remotes, got %d", len(rs.remotes))
+	}
+
+	a, b, c := rs.remotes[0], rs.remotes[1], rs.remotes[2]
+	if a.mp.Host != "1.1.1.1" || a.mp.MinPort != 4000 || a.mp.MaxPort != 4010 || a.priority != 1 || a.weight != 3 {
+		t.Fatalf("unexpected remote: %+v", a)
+	}
+	if b.priority != 1 || b.weight != 1 {
+		t.Fatalf("unexpected defaults: %+v", b)
+	}
+	if c.mp.Host != "[::1]" || c.priority != 2 {
+		t.Fatalf("unexpected remote: %+v", c)
+	}
+
+	for _, s := range []string{"", "1.1.1.1:4000;weight=0", "1.1.1.1:4000;priority=x", "1.1.1.1:4000;color=1", "1.1.1.1:4000,"} {
+		if _, err := parseRemotes(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func TestRemoteSetWeights(t *testing.T) {
+	rs, err := parseRemotes("1.1.1.1:4000;weight=3,2.2.2.2:4000;weight=1,3.3.3.3:4000;priority=2;weight=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := make(map[*remote]int)
+	for i := 0; i < 4000; i++ {
+		picked[rs.pick()]++
+	}
+	if picked[rs.remotes[2]] != 0 {
+		t.Fatal("a lower priority remote was picked while the preferred ones are up")
+	}
+	if n := picked[rs.remotes[0]]; n < 2700 || n > 3300 {
+		t.Fatalf("weight 3 of 4 picked %d times out of 4000", n)
+	}
+}
+
+func TestRemoteSetFailover(t *testing.T) {
+	rs, err := parseRemotes("1.1.1.1:4000,2.2.2.2:4000;priority=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, backup := rs.remotes[0], rs.remotes[1]
+
+	for i := 0; i < remoteMaxFailures-1; i++ {
+		rs.fail(primary)
+	}
+	if rs.pick() != primary {
+		t.Fatal("remote marked down before remoteMaxFailures failures")
+	}
+	rs.fail(primary)
+	if rs.pick() != backup {
+		t.Fatal("expected failover to the backup remote")
+	}
+	if rs.better(backup) {
+		t.Fatal("no remote is better than the backup while the primary is down")
+	}
+
+	// Every remote down: the preferred one is still tried.
+	for i := 0; i < remoteMaxFailures; i++ {
+		rs.fail(backup)
+	}
+	if rs.pick() != primary {
+		t.Fatal("expected the preferred remote when all are down")
+	}
+
+	recovered := rs.recoveredCh()
+	rs.succeed(primary)
+	select {
+	case <-recovered:
+	default:
+		t.Fatal("recovery not signalled")
+	}
+	if !rs.better(backup) || rs.pick() != primary {
+		t.Fatal("expected to go back to the recovered primary")
+	}
+}
+
+func TestRemoteSetSingle(t *testing.T) {
+	rs, err := parseRemotes("1.1.1.1:4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*remoteMaxFailures; i++ {
+		rs.fail(rs.remotes[0])
+	}
+	if rs.remotes[0].down {
+		t.Fatal("a single remote must never be marked down")
+	}
+}
@@ -0,0 +1,126 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+// resumeRetryDelay spaces the attempts to attach a resumable stream to a
+// new session.
+const resumeRetryDelay = time.Second
+
+// resumer moves the resumable streams of a listener to another session of
+// the pool when theirs dies, for up to timeout.
+type resumer struct {
+	pool    *sessionPool
+	timeout time.Duration
+	quiet   func() bool // asked per stream, as reloads change it
+}
+
+// newResumer returns nil when timeout disables resumable streams.
+func newResumer(pool *sessionPool, timeout time.Duration, quiet func() bool) *resumer {
+	if timeout <= 0 {
+		return nil
+	}
+	return &resumer{pool: pool, timeout: timeout, quiet: quiet}
+}
+
+// keep attaches a new leg to rc, opened with hdr, whenever its leg fails,
+// until rc is closed. wrap applies the stream layers to a new leg. The
+// stream is closed when no leg could be attached within the timeout or
+// the server forgot it.
+func (r *resumer) keep(rc *std.ResumeConn, hdr *std.Header, wrap func(*smux.Stream) io.ReadWriteCloser, client net.Addr, streamID string) {
+	quiet := r.quiet()
+	logln := func(v ...any) {
+		if !quiet {
+			log.Println(v...)
+		}
+	}
+
+	reattach := *hdr
+	reattach.Reattach = true
+	for {
+		select {
+		case <-rc.Broken():
+		case <-rc.Done():
+			return
+		}
+
+		deadline := time.Now().Add(r.timeout)
+		for !rc.Attached() {
+			refused, err := r.reattach(rc, &reattach, wrap, client)
+			if err == nil {
+				logln("stream resumed", "in:", client, "out:", streamID)
+				break
+			}
+			if refused || time.Now().After(deadline) {
+				logln("resume:", err, "in:", client, "out:", streamID)
+				rc.Close()
+				return
+			}
+			select {
+			case <-time.After(resumeRetryDelay):
+			case <-rc.Done():
+				return
+			}
+		}
+	}
+}
+
+// reattach opens a new leg for rc on a session of the pool. refused is set
+// when the server does not know the stream anymore, retrying is pointless.
+func (r *resumer) reattach(rc *std.ResumeConn, hdr *std.Header, wrap func(*smux.Stream) io.ReadWriteCloser, client net.Addr) (refused bool, err error) {
+	session, err := r.pool.get(client)
+	if err != nil {
+		return false, err
+	}
+	leg, err := session.OpenStream()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if err := std.WriteHeader(leg, hdr); err != nil {
+		leg.Close()
+		return false, err
+	}
+
+	// Read the reply byte directly, a failing session must not be taken
+	// for a refusal.
+	var code [1]byte
+	if _, err := io.ReadFull(leg, code[:]); err != nil {
+		leg.Close()
+		return false, errors.WithStack(err)
+	}
+	if code[0] != std.ReplyOK {
+		leg.Close()
+		return true, errors.Errorf("stream unknown to the server, reply code %d", code[0])
+	}
+	return false, rc.Attach(wrap(leg))
+}
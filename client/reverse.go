@@ -0,0 +1,185 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/qpp"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// registerRetryMin and registerRetryMax bound the delay before a
+	// registration the server did not answer is sent again, doubled per
+	// attempt. A server taking no headers never answers it.
+	registerRetryMin = time.Second
+	registerRetryMax = time.Minute
+)
+
+// registerTimeout is how long a registration awaits the answer of the server.
+var registerTimeout = handshakeTimeout
+
+// reverseClient serves the reverse tunnels of the client: it registers every
+// tunnel name on each session of the pool and dials the local target of the
+// name for every stream the server opens back.
+type reverseClient struct {
+	rules     map[string]string // tunnel name -> local target
+	_Q_       *qpp.QuantumPermutationPad
+	seed      []byte
+	quiet     bool
+	closeWait int
+}
+
+// serve registers the tunnels on session and accepts the streams opened by
+// the server until the session dies. The pool redials the session, which
+// registers the tunnels again.
+func (r *reverseClient) serve(_ int, session *smux.Session) {
+	for name := range r.rules {
+		go r.keepRegistered(session, name)
+	}
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			log.Println("reverse:", err, "on connection:", session.LocalAddr())
+			break
+		}
+		go r.handle(stream)
+	}
+}
+
+// keepRegistered registers name on session, again with a growing delay
+// while the server does not answer, and holds the registration until the
+// session dies.
+func (r *reverseClient) keepRegistered(session *smux.Session, name string) {
+	delay := registerRetryMin
+	for {
+		reg, err := r.register(session, name)
+		if err == nil {
+			<-session.CloseChan()
+			reg.Close()
+			return
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			log.Println("reverse tunnel:", name, err)
+			return
+		}
+		log.Println("reverse tunnel:", name, "not answered, retrying in", delay)
+		select {
+		case <-time.After(delay):
+		case <-session.CloseChan():
+			return
+		}
+		delay = min(delay*2, registerRetryMax)
+	}
+}
+
+// register opens the stream announcing that session serves name. The server
+// keeps the registration until the stream is closed. Its answer is awaited
+// for up to registerTimeout.
+func (r *reverseClient) register(session *smux.Session, name string) (*smux.Stream, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = std.WriteHeader(stream, &std.Header{Network: std.NetworkReverse, Addr: name})
+	if err == nil {
+		stream.SetReadDeadline(time.Now().Add(registerTimeout))
+		_, err = std.ReadReply(stream)
+		stream.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	log.Println("reverse tunnel registered:", name, "on connection:", session.LocalAddr())
+	return stream, nil
+}
+
+// handle dials the local target of the tunnel named by the header of p1 and
+// relays the stream to it.
+func (r *reverseClient) handle(p1 *smux.Stream) {
+	logln := func(v ...any) {
+		if !r.quiet {
+			log.Println(v...)
+		}
+	}
+
+	defer p1.Close()
+
+	streamID := fmt.Sprintf("%v(%d)", p1.RemoteAddr(), p1.ID())
+
+	p1.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hdr, err := std.ReadHeader(p1)
+	if err != nil {
+		logln("header:", err, "in:", streamID)
+		return
+	}
+	p1.SetReadDeadline(time.Time{})
+
+	target, ok := r.rules[hdr.Addr]
+	if hdr.Network != std.NetworkReverse || !ok {
+		logln("reverse tunnel not configured:", hdr.Network, hdr.Addr, "in:", streamID)
+		std.WriteReply(p1, std.ReplyNotAllowed)
+		return
+	}
+
+	network := "tcp"
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		network = "unix"
+	}
+	p2, err := net.DialTimeout(network, target, dialTimeout)
+	if werr := std.WriteReply(p1, std.ReplyCode(err)); werr != nil && err == nil {
+		p2.Close()
+		err = werr
+	}
+	if err != nil {
+		logln("reverse tunnel:", hdr.Addr, err, "in:", streamID)
+		return
+	}
+	defer p2.Close()
+
+	var s1, s2 io.ReadWriteCloser = p1, p2
+	if r._Q_ != nil {
+		s1 = std.NewQPPPort(p1, r._Q_, r.seed)
+	}
+
+	logln("reverse stream opened", "in:", streamID, "out:", p2.RemoteAddr())
+	defer logln("reverse stream closed", "in:", streamID, "out:", p2.RemoteAddr())
+
+	err1, err2 := std.Pipe(s1, s2, r.closeWait)
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		logln("pipe:", err1, "in:", streamID, "out:", p2.RemoteAddr())
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		logln("pipe:", err2, "in:", streamID, "out:", p2.RemoteAddr())
+	}
+}
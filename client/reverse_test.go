@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+func TestReverseRegisterRetriesUnanswered(t *testing.T) {
+	defer func(d time.Duration) { registerTimeout = d }(registerTimeout)
+	registerTimeout = 100 * time.Millisecond
+
+	c1, c2 := net.Pipe()
+	client, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Client returned error: %v", err)
+	}
+	defer client.Close()
+	server, err := smux.Server(c2, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Server returned error: %v", err)
+	}
+	defer server.Close()
+
+	// The first registration goes unanswered, as with a server taking no
+	// headers, the next one is accepted.
+	registered := make(chan string)
+	go func() {
+		for i := 0; ; i++ {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			hdr, err := std.ReadHeader(stream)
+			if err != nil {
+				t.Errorf("ReadHeader returned error: %v", err)
+				return
+			}
+			if i > 0 {
+				std.WriteReply(stream, std.ReplyOK)
+				registered <- hdr.Addr
+			}
+		}
+	}()
+
+	r := &reverseClient{rules: map[string]string{"ssh": "127.0.0.1:22"}}
+	done := make(chan struct{})
+	go func() {
+		r.keepRegistered(client, "ssh")
+		close(done)
+	}()
+	select {
+	case name := <-registered:
+		if name != "ssh" {
+			t.Fatalf("registered %q, want ssh", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the unanswered registration was not retried")
+	}
+
+	// The registration is held until the session dies.
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keepRegistered still running after the session died")
+	}
+}
@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Strategies for choosing the session that carries a new client.
+const (
+	selectRoundRobin   = "rr"           // rotate over the sessions
+	selectLeastStreams = "leaststreams" // the session with the fewest open streams
+	selectLowestRTT    = "rtt"          // the session with the lowest smoothed RTT
+	selectSticky       = "sticky"       // stick to a session chosen by the client's IP
+	selectBond         = "bond"         // stripe over all sessions, favoring the fastest paths
+)
+
+// bondMinRTO keeps sessions with a near zero RTO from taking all the load in
+// bonding mode, in milliseconds.
+const bondMinRTO = 10
+
+// sessionStats is the state of one pool slot as seen by a selector.
+type sessionStats struct {
+	alive   bool  // the slot holds a healthy session, others must not be picked
+	streams int   // open streams, see smux.Session.NumStreams
+	srtt    int32 // smoothed RTT in ms, see kcp.UDPSession.GetSRTT
+	rttvar  int32 // RTT variation in ms, see kcp.UDPSession.GetSRTTVar
+}
+
+// sessionSelector picks the pool slot for a new client among the alive ones,
+// or returns -1 when there is none. It is called with the pool locked, so
+// implementations need no locking of their own.
+type sessionSelector interface {
+	pick(client net.Addr, slots []sessionStats) int
+}
+
+// newSessionSelector returns the selector implementing strategy.
+func newSessionSelector(strategy string) (sessionSelector, error) {
+	switch strategy {
+	case selectRoundRobin:
+		return new(roundRobinSelector), nil
+	case selectLeastStreams:
+		return &minSelector{key: func(s sessionStats) int64 { return int64(s.streams) }}, nil
+	case selectLowestRTT:
+		return &minSelector{key: func(s sessionStats) int64 { return int64(s.srtt) }}, nil
+	case selectSticky:
+		return new(stickySelector), nil
+	case selectBond:
+		return bondSelector{}, nil
+	default:
+		return nil, errors.Errorf("unsupported session selection: %v", strategy)
+	}
+}
+
+// nextAlive walks the slots from start and returns the first alive one.
+func nextAlive(slots []sessionStats, start int) int {
+	for i := range slots {
+		idx := (start + i) % len(slots)
+		if slots[idx].alive {
+			return idx
+		}
+	}
+	return -1
+}
+
+// roundRobinSelector rotates over the alive slots regardless of their load.
+type roundRobinSelector struct {
+	rr uint32
+}
+
+func (s *roundRobinSelector) pick(_ net.Addr, slots []sessionStats) int {
+	idx := nextAlive(slots, int(s.rr%uint32(len(slots))))
+	s.rr = uint32(idx + 1)
+	return idx
+}
+
+// minSelector picks the alive slot with the smallest key. Ties are broken in
+// round-robin order so equal sessions share the load.
+type minSelector struct {
+	key func(sessionStats) int64
+	rr  uint32
+}
+
+func (s *minSelector) pick(_ net.Addr, slots []sessionStats) int {
+	n := len(slots)
+	start := int(s.rr % uint32(n))
+	s.rr++
+
+	best := -1
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		if !slots[idx].alive {
+			continue
+		}
+		if best < 0 || s.key(slots[idx]) < s.key(slots[best]) {
+			best = idx
+		}
+	}
+	return best
+}
+
+// stickySelector keeps every client IP on the same slot, so the connections
+// of one client share a single session. While that session is down they move
+// to the next alive slot, leaving the other clients in place. Clients without
+// an IP, such as unix socket peers, are spread in round-robin order.
+type stickySelector struct {
+	roundRobinSelector
+}
+
+func (s *stickySelector) pick(client net.Addr, slots []sessionStats) int {
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return s.roundRobinSelector.pick(client, slots)
+	}
+
+	h := fnv.New32a()
+	h.Write(ip.To16())
+	return nextAlive(slots, int(h.Sum32()%uint32(len(slots))))
+}
+
+// bondSelector stripes new clients over every alive session, each getting a
+// share inversely proportional to the RTO KCP estimates for it, srtt plus
+// four times rttvar. A path whose latency or jitter grows, as loss and
+// bufferbloat make it on radio links, thus gets less of the new load
+// without being abandoned, and wins it back once it recovers.
+type bondSelector struct{}
+
+func (bondSelector) pick(_ net.Addr, slots []sessionStats) int {
+	weights := make([]float64, len(slots))
+	var total float64
+	for i, s := range slots {
+		if s.alive {
+			weights[i] = 1 / float64(bondMinRTO+s.srtt+4*s.rttvar)
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	n := rand.Float64() * total
+	last := -1
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		if n -= w; n < 0 {
+			return i
+		}
+		last = i
+	}
+	return last
+}
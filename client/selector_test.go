@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func mustSelector(t *testing.T, strategy string) sessionSelector {
+	t.Helper()
+	s, err := newSessionSelector(strategy)
+	if err != nil {
+		t.Fatalf("newSessionSelector(%q) returned error: %v", strategy, err)
+	}
+	return s
+}
+
+func liveSlots(n int) []sessionStats {
+	slots := make([]sessionStats, n)
+	for i := range slots {
+		slots[i].alive = true
+	}
+	return slots
+}
+
+func TestNewSessionSelector(t *testing.T) {
+	for _, strategy := range []string{selectRoundRobin, selectLeastStreams, selectLowestRTT, selectSticky, selectBond} {
+		mustSelector(t, strategy)
+	}
+	if _, err := newSessionSelector("random"); err == nil {
+		t.Fatal("expected error for an unknown strategy")
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := mustSelector(t, selectRoundRobin)
+	slots := liveSlots(3)
+	slots[0].streams = 100
+	for i := 0; i < 6; i++ {
+		if got := s.pick(nil, slots); got != i%3 {
+			t.Fatalf("pick %d: got slot %d, want %d", i, got, i%3)
+		}
+	}
+}
+
+func TestLeastStreamsSelector(t *testing.T) {
+	s := mustSelector(t, selectLeastStreams)
+	slots := liveSlots(3)
+	slots[0].streams = 5
+	slots[1].streams = 1
+	slots[2].streams = 3
+	for i := 0; i < 3; i++ {
+		if got := s.pick(nil, slots); got != 1 {
+			t.Fatalf("got slot %d, want the least loaded slot 1", got)
+		}
+	}
+
+	// Equally loaded sessions share the clients.
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seen[s.pick(nil, liveSlots(3))] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("ties must rotate over the slots, got %v", seen)
+	}
+}
+
+func TestLowestRTTSelector(t *testing.T) {
+	s := mustSelector(t, selectLowestRTT)
+	slots := liveSlots(3)
+	slots[0].srtt = 80
+	slots[1].srtt = 200
+	slots[2].srtt = 40
+	if got := s.pick(nil, slots); got != 2 {
+		t.Fatalf("got slot %d, want the fastest slot 2", got)
+	}
+
+	// Slots without a healthy session are never picked.
+	slots[2].alive = false
+	if got := s.pick(nil, slots); got != 0 {
+		t.Fatalf("got slot %d, want the fastest alive slot 0", got)
+	}
+}
+
+func TestSelectorsSkipDeadSlots(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	for _, strategy := range []string{selectRoundRobin, selectLeastStreams, selectLowestRTT, selectSticky, selectBond} {
+		s := mustSelector(t, strategy)
+		if got := s.pick(client, make([]sessionStats, 3)); got != -1 {
+			t.Fatalf("%v: got slot %d with no alive slot, want -1", strategy, got)
+		}
+
+		slots := make([]sessionStats, 3)
+		slots[1].alive = true
+		for i := 0; i < 3; i++ {
+			if got := s.pick(client, slots); got != 1 {
+				t.Fatalf("%v: got slot %d, want the only alive slot 1", strategy, got)
+			}
+		}
+	}
+}
+
+func TestStickySelector(t *testing.T) {
+	s := mustSelector(t, selectSticky)
+	slots := liveSlots(8)
+
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2000}
+	if s.pick(a, slots) != s.pick(b, slots) {
+		t.Fatal("connections from the same IP must share a slot")
+	}
+	u := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3000}
+	if s.pick(a, slots) != s.pick(u, slots) {
+		t.Fatal("udp flows from the same IP must share a slot")
+	}
+
+	// Peers without an IP fall back to round-robin.
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+	if s.pick(unix, slots) == s.pick(unix, slots) {
+		t.Fatal("unix peers must rotate over the slots")
+	}
+
+	// Only the clients of a dead slot move, to the next alive one.
+	home := s.pick(a, slots)
+	slots[home].alive = false
+	if got := s.pick(a, slots); got != (home+1)%len(slots) {
+		t.Fatalf("got slot %d, want the successor of slot %d", got, home)
+	}
+}
+
+func TestBondSelector(t *testing.T) {
+	s := mustSelector(t, selectBond)
+	slots := liveSlots(3)
+	slots[0].srtt = 20                     // RTO of 30ms with bondMinRTO
+	slots[1].srtt, slots[1].rttvar = 50, 5 // RTO of 90ms
+	slots[2].alive = false
+
+	picked := make([]int, 3)
+	for i := 0; i < 4000; i++ {
+		picked[s.pick(nil, slots)]++
+	}
+	if picked[2] != 0 {
+		t.Fatal("bonding picked a dead session")
+	}
+	// shares of 1/30 and 1/90: 3000 and 1000 of 4000
+	if picked[0] < 2700 || picked[0] > 3300 {
+		t.Fatalf("the fast path got %d of 4000 clients, want about 3000", picked[0])
+	}
+	if picked[1] == 0 {
+		t.Fatal("the slow path must keep a share of the clients")
+	}
+}
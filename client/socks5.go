@@ -0,0 +1,221 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth   = 0x00
+	socks5MethodUserPass = 0x02
+	socks5MethodNone     = 0xff
+
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded        = 0x00
+	socks5RepFailure          = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepHostUnreachable  = 0x04
+	socks5RepRefused          = 0x05
+	socks5RepTTLExpired       = 0x06
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+)
+
+// socks5Handshake returns a handshakeFunc serving the SOCKS5 CONNECT command.
+// Username/password authentication is required when user is not empty.
+func socks5Handshake(user, pass string) handshakeFunc {
+	return func(p1 net.Conn) (*std.Header, replyFunc, error) {
+		if err := socks5Auth(p1, user, pass); err != nil {
+			return nil, nil, err
+		}
+
+		addr, err := socks5Request(p1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reply := func(_ io.Writer, code byte) error {
+			return socks5Reply(p1, socks5ReplyCode(code))
+		}
+		return &std.Header{Network: "tcp", Addr: addr}, reply, nil
+	}
+}
+
+// socks5Auth negotiates the authentication method and verifies credentials.
+func socks5Auth(conn net.Conn, user, pass string) error {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if greeting[0] != socks5Version {
+		return errors.Errorf("socks5: unsupported version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return errors.WithStack(err)
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if user != "" {
+		want = socks5MethodUserPass
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5MethodNone})
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if want == socks5MethodNoAuth {
+		return nil
+	}
+
+	// RFC 1929: VER | ULEN | UNAME | PLEN | PASSWD
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if hdr[0] != socks5UserPassVersion {
+		return errors.Errorf("socks5: unsupported auth version %d", hdr[0])
+	}
+	uname := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.ReadFull(conn, hdr[1:]); err != nil {
+		return errors.WithStack(err)
+	}
+	passwd := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return errors.WithStack(err)
+	}
+
+	userOK := subtle.ConstantTimeCompare(uname, []byte(user)) == 1
+	passOK := subtle.ConstantTimeCompare(passwd, []byte(pass)) == 1
+	if !userOK || !passOK {
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return errors.New("socks5: authentication failed")
+	}
+	_, err := conn.Write([]byte{socks5UserPassVersion, 0x00})
+	return errors.WithStack(err)
+}
+
+// socks5Request reads a CONNECT request and returns the requested host:port.
+func socks5Request(conn net.Conn) (string, error) {
+	// VER | CMD | RSV | ATYP
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if req[0] != socks5Version {
+		return "", errors.Errorf("socks5: unsupported version %d", req[0])
+	}
+	if req[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5RepCmdNotSupported)
+		return "", errors.Errorf("socks5: unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", errors.WithStack(err)
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", errors.WithStack(err)
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5RepAtypNotSupported)
+		return "", errors.Errorf("socks5: unsupported address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5Reply answers a request; the bound address is not meaningful for a
+// tunneled connection and is always reported as 0.0.0.0:0.
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return errors.WithStack(err)
+}
+
+// socks5ReplyCode translates a server reply code into a SOCKS5 reply field.
+func socks5ReplyCode(code byte) byte {
+	switch code {
+	case std.ReplyOK:
+		return socks5RepSucceeded
+	case std.ReplyNotAllowed:
+		return socks5RepNotAllowed
+	case std.ReplyUnreachable:
+		return socks5RepHostUnreachable
+	case std.ReplyRefused:
+		return socks5RepRefused
+	case std.ReplyTimeout:
+		return socks5RepTTLExpired
+	default:
+		return socks5RepFailure
+	}
+}
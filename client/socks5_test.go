@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestSocks5HandshakeUserPass(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		hdr   *std.Header
+		reply replyFunc
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		hdr, reply, err := socks5Handshake("alice", "secret")(server)
+		done <- result{hdr, reply, err}
+	}()
+
+	// greeting offering no-auth and username/password
+	client.Write([]byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUserPass})
+	expectBytes(t, client, []byte{socks5Version, socks5MethodUserPass})
+
+	client.Write(append(append([]byte{socks5UserPassVersion, 5}, "alice"...), append([]byte{6}, "secret"...)...))
+	expectBytes(t, client, []byte{socks5UserPassVersion, 0x00})
+
+	// CONNECT example.com:443
+	req := append([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypDomain, 11}, "example.com"...)
+	client.Write(append(req, 0x01, 0xbb))
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("handshake returned error: %v", res.err)
+	}
+	if res.hdr.Network != "tcp" || res.hdr.Addr != "example.com:443" {
+		t.Fatalf("unexpected header: %+v", res.hdr)
+	}
+
+	go res.reply(nil, std.ReplyRefused)
+	expectBytes(t, client, []byte{socks5Version, socks5RepRefused, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func TestSocks5HandshakeBadPassword(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := socks5Handshake("alice", "secret")(server)
+		done <- err
+	}()
+
+	client.Write([]byte{socks5Version, 1, socks5MethodUserPass})
+	expectBytes(t, client, []byte{socks5Version, socks5MethodUserPass})
+	client.Write(append(append([]byte{socks5UserPassVersion, 5}, "alice"...), append([]byte{5}, "wrong"...)...))
+	expectBytes(t, client, []byte{socks5UserPassVersion, 0x01})
+
+	if err := <-done; err == nil {
+		t.Fatalf("handshake expected authentication error")
+	}
+}
+
+func TestSocks5HandshakeIPv6NoAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan *std.Header, 1)
+	go func() {
+		hdr, _, _ := socks5Handshake("", "")(server)
+		done <- hdr
+	}()
+
+	client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	expectBytes(t, client, []byte{socks5Version, socks5MethodNoAuth})
+	req := append([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv6}, net.ParseIP("::1")...)
+	client.Write(append(req, 0x00, 0x16))
+
+	if hdr := <-done; hdr == nil || hdr.Addr != "[::1]:22" {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+}
+
+func expectBytes(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/qpp"
+)
+
+// stdio joins stdin and stdout into the local end of a stream.
+type stdio struct {
+	in  io.ReadCloser
+	out io.WriteCloser
+}
+
+func (s stdio) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s stdio) Write(p []byte) (int, error) { return s.out.Write(p) }
+
+// CloseWrite tells the program reading our stdout that the stream ended.
+func (s stdio) CloseWrite() error { return s.out.Close() }
+
+func (s stdio) Close() error {
+	s.in.Close()
+	return s.out.Close()
+}
+
+// runStdio dials a single session, opens one stream on it, to -target if
+// set, and pipes it to in and out, stdin and stdout, until both sides are
+// done.
+func runStdio(config *Config, block kcp.BlockCrypt, _Q_ *qpp.QuantumPermutationPad, in io.ReadCloser, out io.WriteCloser) error {
+	var path string
+	if len(config.Bind) > 0 {
+		path = config.Bind[0]
+	}
+	ts, err := createConn(config, block, path)
+	if err != nil {
+		return err
+	}
+	defer ts.session.Close()
+
+	p2, err := ts.session.OpenStream()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer p2.Close()
+
+	if config.Target != "" {
+		// The header and its reply travel before QPP wraps the stream.
+		if err := std.WriteHeader(p2, targetHeader(config.Target, false)); err != nil {
+			return err
+		}
+		if _, err := std.ReadReply(p2); err != nil {
+			return errors.WithMessage(err, config.Target)
+		}
+	}
+
+	var s2 io.ReadWriteCloser = p2
+	if _Q_ != nil {
+		s2 = std.NewQPPPort(p2, _Q_, []byte(config.Key))
+	}
+
+	// Either side closing ends the pipe, which is not a failure. There is
+	// no closewait: ssh is waiting for the process to exit.
+	err1, err2 := std.Pipe(stdio{in, out}, s2, 0)
+	for _, err := range []error{err1, err2} {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+func TestRunStdio(t *testing.T) {
+	lis, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatalf("ListenWithOptions returned error: %v", err)
+	}
+	defer lis.Close()
+
+	// An echo server, closing the stream once the client is done.
+	go func() {
+		conn, err := lis.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		mux, err := smux.Server(conn, smux.DefaultConfig())
+		if err != nil {
+			return
+		}
+		defer mux.Close()
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+
+	config := &Config{RemoteAddr: lis.Addr().String(), Conn: 1}
+	config.NoComp, config.Mode, config.MTU, config.SndWnd, config.RcvWnd = true, "fast", 1350, 128, 128
+	config.SmuxVer, config.SmuxBuf, config.StreamBuf, config.FrameSize, config.KeepAlive = 1, 4194304, 2097152, 8192, 10
+	config.CloseWait = 30 // ignored by stdio mode
+	config.ApplyMode()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- runStdio(config, nil, nil, inR, outW) }()
+
+	go inW.Write([]byte("hello"))
+	buf := make([]byte, len("hello"))
+	if _, err := io.ReadFull(outR, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("stream not piped: %q %v", buf, err)
+	}
+
+	// ssh exiting closes our stdin, which must end the process at once.
+	inW.Close()
+	if _, err := io.ReadAll(outR); err != nil {
+		t.Fatalf("reading stdout returned error: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runStdio returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runStdio did not return after stdin closed")
+	}
+}
@@ -0,0 +1,134 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSoOriginalDst = 80
+
+// listenTransparent listens on addr for connections redirected by the
+// firewall. In tproxy mode the socket is marked IP_TRANSPARENT so it can
+// accept connections addressed to foreign destinations.
+func listenTransparent(mode, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if mode == tproxyTPROXY {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); serr != nil {
+					return
+				}
+				if network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return errors.Wrap(serr, "IP_TRANSPARENT")
+		}
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	return listener, errors.WithStack(err)
+}
+
+// transparentHandshake returns a handshakeFunc requesting the original
+// destination of connections redirected to listener by REDIRECT (read with
+// SO_ORIGINAL_DST) or TPROXY (the local address of the connection).
+func transparentHandshake(mode string, listener net.Addr) handshakeFunc {
+	return func(p1 net.Conn) (*std.Header, replyFunc, error) {
+		dst := p1.LocalAddr().(*net.TCPAddr).AddrPort()
+		if mode == tproxyRedirect {
+			var err error
+			if dst, err = originalDst(p1); err != nil {
+				return nil, nil, err
+			}
+		}
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+		// A connection made to the listener itself has nowhere else to go,
+		// forwarding it would loop back here.
+		self := listener.(*net.TCPAddr)
+		if dst.Port() == uint16(self.Port) && (self.IP.IsUnspecified() || self.IP.Equal(dst.Addr().AsSlice())) {
+			return nil, nil, errors.Errorf("connection to the listener itself: %v", dst)
+		}
+		return &std.Header{Network: "tcp", Addr: dst.String()}, nil, nil
+	}
+}
+
+// originalDst reads the destination of a connection before it was rewritten
+// by an iptables/nftables REDIRECT rule.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("SO_ORIGINAL_DST: not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, errors.WithStack(err)
+	}
+
+	// IPv4 connections accepted on a dual-stack socket are tracked by
+	// conntrack as IPv4, so the local address decides the level to query.
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	var dst netip.AddrPort
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Unmap().Is4() {
+			// struct sockaddr_in fits into the 16 bytes of an IPv6Mreq.
+			var mreq *unix.IPv6Mreq
+			if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); serr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+
+		// struct sockaddr_in6 fits into an IPv6MTUInfo.
+		var info *unix.IPv6MTUInfo
+		if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); serr == nil {
+			port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), port)
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, errors.WithStack(err)
+	}
+	if serr != nil {
+		return netip.AddrPort{}, errors.Wrap(serr, "SO_ORIGINAL_DST")
+	}
+	return dst, nil
+}
@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/qpp"
+)
+
+// udpQueueLen is the number of datagrams buffered per flow while its stream
+// is being set up or is congested; excess datagrams are dropped.
+const udpQueueLen = 128
+
+// udpFlow tracks the datagrams of one local source address.
+type udpFlow struct {
+	ch         chan []byte
+	lastActive atomic.Int64 // unix nanoseconds
+}
+
+func (f *udpFlow) touch() { f.lastActive.Store(time.Now().UnixNano()) }
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// serveUDP relays datagrams received on conn through the tunnel. Every local
+// source address gets its own smux stream, which is torn down once it has
+// seen no traffic in either direction for timeout. Each stream goes to the
+// target of the running config, and follows its quiet setting.
+func serveUDP(conn *net.UDPConn, pool *sessionPool, acl *std.ACL, running *atomic.Pointer[Config], _Q_ *qpp.QuantumPermutationPad, seed []byte, timeout time.Duration) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	std.OnShutdown(func() { conn.Close() })
+	buf := make([]byte, std.MaxDatagramSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if std.Draining() {
+				return
+			}
+			log.Fatalf("%+v", err)
+		}
+
+		key := src.String()
+		mu.Lock()
+		flow, ok := flows[key]
+		if !ok && !acl.Admit(src) {
+			mu.Unlock()
+			continue
+		}
+		if !ok {
+			flow = &udpFlow{ch: make(chan []byte, udpQueueLen)}
+			flow.touch()
+			flows[key] = flow
+			config := running.Load()
+			hdr := &std.Header{Network: "udp", Addr: config.Target}
+			go func() {
+				handleUDPFlow(conn, src, flow, pool, hdr, _Q_, seed, config.Quiet, timeout)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case flow.ch <- append([]byte(nil), buf[:n]...):
+		default: // queue full, drop as a congested link would
+		}
+	}
+}
+
+// handleUDPFlow carries the datagrams of src over a dedicated smux stream and
+// writes the answers back to src.
+func handleUDPFlow(conn *net.UDPConn, src *net.UDPAddr, flow *udpFlow, pool *sessionPool, hdr *std.Header, _Q_ *qpp.QuantumPermutationPad, seed []byte, quiet bool, timeout time.Duration) {
+	logln := func(v ...any) {
+		if !quiet {
+			log.Println(v...)
+		}
+	}
+
+	session, err := pool.get(src)
+	if err != nil {
+		logln(err, "in:", src)
+		return
+	}
+	p2, err := session.OpenStream()
+	if err != nil {
+		logln(err)
+		return
+	}
+	defer p2.Close()
+
+	streamID := fmt.Sprintf("%v(%d)", p2.RemoteAddr(), p2.ID())
+	if err := std.WriteHeader(p2, hdr); err != nil {
+		logln("header:", err, "out:", streamID)
+		return
+	}
+	if _, err := std.ReadReply(p2); err != nil {
+		logln("target:", hdr.Addr, err, "in:", src, "out:", streamID)
+		return
+	}
+
+	logln("udp stream opened", "in:", src, "out:", streamID)
+	defer logln("udp stream closed", "in:", src, "out:", streamID)
+
+	var s2 io.ReadWriteCloser = p2
+	if _Q_ != nil {
+		s2 = std.NewQPPPort(p2, _Q_, seed)
+	}
+
+	// stream -> local source
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, std.MaxDatagramSize)
+		for {
+			n, err := std.ReadDatagram(s2, buf)
+			if err != nil {
+				// the stream is closed locally when the flow idles out
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+					logln("pipe:", err, "in:", src, "out:", streamID)
+				}
+				return
+			}
+			if _, err := conn.WriteToUDP(buf[:n], src); err != nil {
+				logln("pipe:", err, "in:", src, "out:", streamID)
+				return
+			}
+			flow.touch()
+		}
+	}()
+
+	// local source -> stream, until the flow idles out or the stream ends
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case p := <-flow.ch:
+			if err := std.WriteDatagram(s2, p); err != nil {
+				logln("pipe:", err, "in:", src, "out:", streamID)
+				return
+			}
+			flow.touch()
+		case <-ticker.C:
+			if flow.idle() > timeout {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
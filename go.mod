@@ -10,6 +10,9 @@ require (
 	github.com/xtaci/smux v1.5.55
 	github.com/xtaci/tcpraw v1.2.32
 	golang.org/x/crypto v0.47.0
+	golang.org/x/net v0.49.0
+	golang.org/x/sys v0.40.0
+	golang.org/x/time v0.14.0
 )
 
 require (
@@ -22,9 +25,6 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
-	golang.org/x/net v0.49.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
-	golang.org/x/time v0.14.0 // indirect
 )
 
 // replace github.com/xtaci/smux => /home/xtaci/go/src/github.com/xtaci/smux
@@ -0,0 +1,182 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Balancing policies across the configured targets.
+const (
+	balanceRoundRobin = "rr"        // rotate over the healthy backends
+	balanceLeastConn  = "leastconn" // the healthy backend with the fewest open connections
+	balanceHash       = "hash"      // stick to a backend chosen by the client's IP
+)
+
+// backend is one of the targets the default destination is balanced across.
+type backend struct {
+	network string
+	addr    string
+	down    atomic.Bool  // set by failed health checks or dials
+	conns   atomic.Int64 // open connections, for leastconn
+}
+
+// balancer spreads the streams for the default destination over several
+// backends, skipping the ones known to be down.
+type balancer struct {
+	backends []*backend
+	policy   string
+	rr       atomic.Uint32
+}
+
+// newBalancer creates a balancer over targets, each a host:port or a unix
+// socket path.
+func newBalancer(targets []string, policy string) (*balancer, error) {
+	switch policy {
+	case balanceRoundRobin, balanceLeastConn, balanceHash:
+	default:
+		return nil, errors.Errorf("unsupported balance policy: %v", policy)
+	}
+
+	b := &balancer{policy: policy}
+	for _, target := range targets {
+		network := "tcp"
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			network = "unix"
+		}
+		b.backends = append(b.backends, &backend{network: network, addr: target})
+	}
+	return b, nil
+}
+
+// order returns the backends in the order they should be tried for client.
+// Backends that are down come last, so they are only tried when no healthy
+// one could be reached.
+func (b *balancer) order(client string) []*backend {
+	n := len(b.backends)
+	list := make([]*backend, 0, n)
+
+	var start int
+	switch b.policy {
+	case balanceRoundRobin:
+		start = int((b.rr.Add(1) - 1) % uint32(n))
+	case balanceHash:
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		start = int(h.Sum32() % uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		list = append(list, b.backends[(start+i)%n])
+	}
+
+	if b.policy == balanceLeastConn {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].conns.Load() < list[j].conns.Load()
+		})
+	}
+
+	// Walking the ring from the same start keeps the clients of a failed
+	// backend together on its successor, and leaves the others in place.
+	sort.SliceStable(list, func(i, j int) bool {
+		return !list[i].down.Load() && list[j].down.Load()
+	})
+	return list
+}
+
+// dial connects to the first reachable backend in the order chosen for
+// client, retrying on the next one after a failure.
+func (b *balancer) dial(client string, timeout time.Duration) (net.Conn, error) {
+	var err error
+	for _, be := range b.order(client) {
+		var conn net.Conn
+		conn, err = net.DialTimeout(be.network, be.addr, timeout)
+		if err != nil {
+			if !be.down.Swap(true) {
+				log.Println("backend down:", be.addr, err)
+			}
+			continue
+		}
+		if be.down.Swap(false) {
+			log.Println("backend up:", be.addr)
+		}
+		be.conns.Add(1)
+		return &backendConn{Conn: conn, backend: be}, nil
+	}
+	return nil, err
+}
+
+// healthCheck probes every backend with a TCP connect each interval and
+// brings them in and out of rotation accordingly.
+func (b *balancer) healthCheck(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, be := range b.backends {
+			wg.Add(1)
+			go func(be *backend) {
+				defer wg.Done()
+				conn, err := net.DialTimeout(be.network, be.addr, timeout)
+				if err != nil {
+					if !be.down.Swap(true) {
+						log.Println("backend down:", be.addr, err)
+					}
+					return
+				}
+				conn.Close()
+				if be.down.Swap(false) {
+					log.Println("backend up:", be.addr)
+				}
+			}(be)
+		}
+		wg.Wait()
+	}
+}
+
+// backendConn releases its slot of the backend's connection count on Close.
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() { c.backend.conns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection when the backend supports it.
+func (c *backendConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
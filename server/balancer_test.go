@@ -0,0 +1,172 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func testBackends(t *testing.T, n int) []string {
+	t.Helper()
+	var targets []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		targets = append(targets, l.Addr().String())
+	}
+	return targets
+}
+
+// closedPort returns an address nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	lb, err := newBalancer([]string{"a:1", "b:1", "c:1"}, balanceRoundRobin)
+	if err != nil {
+		t.Fatalf("newBalancer returned error: %v", err)
+	}
+	for i, want := range []string{"a:1", "b:1", "c:1", "a:1"} {
+		if got := lb.order("client")[0].addr; got != want {
+			t.Fatalf("pick %d: got %v want %v", i, got, want)
+		}
+	}
+
+	lb.backends[1].down.Store(true)
+	list := lb.order("client") // starts at b:1
+	if list[0].addr != "c:1" || list[2].addr != "b:1" {
+		t.Fatalf("down backends must come last: %v %v %v", list[0].addr, list[1].addr, list[2].addr)
+	}
+
+	// The counter wraps around without ever going negative.
+	lb.backends[1].down.Store(false)
+	lb.rr.Store(math.MaxUint32)
+	if got := lb.order("client")[0].addr; got != "a:1" { // 4294967295 % 3
+		t.Fatalf("pick at the wraparound: got %v want a:1", got)
+	}
+	if got := lb.order("client")[0].addr; got != "a:1" {
+		t.Fatalf("pick after the wraparound: got %v want a:1", got)
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	lb, err := newBalancer([]string{"a:1", "b:1", "c:1"}, balanceLeastConn)
+	if err != nil {
+		t.Fatalf("newBalancer returned error: %v", err)
+	}
+	lb.backends[0].conns.Store(3)
+	lb.backends[1].conns.Store(1)
+	lb.backends[2].conns.Store(2)
+	if got := lb.order("client")[0].addr; got != "b:1" {
+		t.Fatalf("got %v want b:1", got)
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	lb, err := newBalancer([]string{"a:1", "b:1", "c:1"}, balanceHash)
+	if err != nil {
+		t.Fatalf("newBalancer returned error: %v", err)
+	}
+	first := lb.order("10.0.0.1")[0]
+	for i := 0; i < 10; i++ {
+		if got := lb.order("10.0.0.1")[0]; got != first {
+			t.Fatalf("hash must stick to %v, got %v", first.addr, got.addr)
+		}
+	}
+
+	first.down.Store(true)
+	if got := lb.order("10.0.0.1")[0]; got == first {
+		t.Fatal("a down backend must not be picked first")
+	}
+}
+
+func TestBalancerDialRetriesNextBackend(t *testing.T) {
+	targets := append([]string{closedPort(t)}, testBackends(t, 1)...)
+	lb, err := newBalancer(targets, balanceRoundRobin)
+	if err != nil {
+		t.Fatalf("newBalancer returned error: %v", err)
+	}
+
+	conn, err := lb.dial("client", time.Second)
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	if !lb.backends[0].down.Load() {
+		t.Fatal("the unreachable backend should be marked down")
+	}
+	if n := lb.backends[1].conns.Load(); n != 1 {
+		t.Fatalf("expected 1 open connection, got %d", n)
+	}
+	conn.Close()
+	conn.Close()
+	if n := lb.backends[1].conns.Load(); n != 0 {
+		t.Fatalf("expected 0 open connections, got %d", n)
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	targets := append(testBackends(t, 1), closedPort(t))
+	lb, err := newBalancer(targets, balanceRoundRobin)
+	if err != nil {
+		t.Fatalf("newBalancer returned error: %v", err)
+	}
+	lb.backends[0].down.Store(true)
+
+	go lb.healthCheck(10*time.Millisecond, time.Second)
+	deadline := time.Now().Add(2 * time.Second)
+	for lb.backends[0].down.Load() || !lb.backends[1].down.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("health check did not update the backends")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewBalancerRejectsUnknownPolicy(t *testing.T) {
+	if _, err := newBalancer([]string{"a:1"}, "random"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
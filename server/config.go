@@ -28,9 +28,33 @@ import (
 
 // Config defines the server-side settings supplied via flags or JSON.
 type Config struct {
-	std.BaseConfig        // Embed shared configuration
-	Listen         string `json:"listen"`
-	Target         string `json:"target"`
+	std.BaseConfig            // Embed shared configuration
+	Listen           string   `json:"listen"`
+	Target           string   `json:"target"`
+	AllowTargets     []string `json:"allowtargets"`     // destinations clients may request per stream
+	HeaderTimeout    int      `json:"headertimeout"`    // milliseconds to wait for the header of a stream
+	UDP              bool     `json:"udp"`              // accept UDP streams
+	Reverse          []string `json:"reverse"`          // reverse tunnels as name=listenaddr
+	Targets          []string `json:"targets"`          // backends balancing the default target
+	Balance          string   `json:"balance"`          // rr, leastconn or hash
+	HealthCheck      int      `json:"healthcheck"`      // seconds between backend health checks, 0 to disable
+	ProxyProtocol    []string `json:"proxyprotocol"`    // PROXY protocol per target as pattern=v1|v2
+	Redundant        bool     `json:"redundant"`        // join the legs of redundant streams
+	PortHop          bool     `json:"porthop"`          // serve the UDP ports of the listen range as one, so sessions can move between them
+	Migrate          bool     `json:"migrate"`          // let sessions follow their clients to a new address
+	Resume           int      `json:"resume"`           // seconds a resumable stream waits for a new leg, 0 to disable
+	MinPorts         int      `json:"minports"`         // ports of the listen range that must bind at startup, 0 for all
+	MaxSessions      int      `json:"maxsessions"`      // sessions open at once, 0 for no limit
+	MaxSessionsPerIP int      `json:"maxsessionsperip"` // sessions open at once from a single IP, 0 for no limit
+	MaxStreams       int      `json:"maxstreams"`       // streams open at once per session, 0 for no limit
+	StreamRate       int      `json:"streamrate"`       // streams opened per second per session, 0 for no limit
+}
+
+// acceptsHeaders reports whether streams may start with a destination header.
+// Probing for it delays silent streams of older clients, so it is only done
+// when a feature relying on the header is enabled.
+func (c *Config) acceptsHeaders() bool {
+	return len(c.AllowTargets) > 0 || c.UDP || len(c.Reverse) > 0 || len(c.ProxyProtocol) > 0 || c.Redundant || c.Resume > 0
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -0,0 +1,185 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"golang.org/x/time/rate"
+)
+
+// Limit statistics, written to the SNMP log.
+var (
+	sessionsRejected = std.NewCounter("SessionsRejected") // sessions closed over -maxsessions or -maxsessionsperip
+	streamsRejected  = std.NewCounter("StreamsRejected")  // streams closed over -maxstreams or -streamrate
+)
+
+// rejectLog reports the sessions and streams rejected, at most once a second.
+var rejectLog = std.NewRateLog(time.Second)
+
+const (
+	// rejectTTL is how long a client turned down is remembered, its
+	// packets in the meantime are not counted again.
+	rejectTTL = 10 * time.Second
+
+	// maxRejected caps the clients turned down remembered at once.
+	maxRejected = 4096
+)
+
+// limits caps what clients may open on the server. A cap of 0 is left out.
+type limits struct {
+	maxSessions int // sessions open at once
+	maxPerIP    int // sessions open at once from a single IP
+	maxStreams  int // streams open at once per session
+	streamRate  int // streams opened per second per session
+
+	mu       sync.Mutex
+	sessions int
+	perIP    map[string]int
+	open     map[string]int  // sessions by client address
+	rejected *std.PeerMemory // clients turned down lately
+}
+
+func newLimits(config *Config) *limits {
+	return &limits{
+		maxSessions: config.MaxSessions,
+		maxPerIP:    config.MaxSessionsPerIP,
+		maxStreams:  config.MaxStreams,
+		streamRate:  config.StreamRate,
+		perIP:       make(map[string]int),
+		open:        make(map[string]int),
+		rejected:    std.NewPeerMemory(rejectTTL, maxRejected),
+	}
+}
+
+// hostOf returns the IP of addr, the sessions per IP are counted by.
+func hostOf(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// full tells why a new session from ip would be over a cap, nil if none.
+// l.mu must be held.
+func (l *limits) full(ip string) error {
+	if l.maxSessions > 0 && l.sessions >= l.maxSessions {
+		return errors.Errorf("maxsessions reached: %d sessions open", l.sessions)
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return errors.Errorf("maxsessionsperip reached: %d sessions open from %v", l.perIP[ip], ip)
+	}
+	return nil
+}
+
+// admitPacket tells whether a packet from addr may reach kcp-go, see
+// std.AdmitConn. The packets of open sessions always do, those of a new
+// client only while its session would be under the caps, so kcp-go never
+// sets one up over them. A client turned down is counted once per
+// rejectTTL, however many packets it sends.
+func (l *limits) admitPacket(addr net.Addr) bool {
+	if l.maxSessions <= 0 && l.maxPerIP <= 0 {
+		return true
+	}
+	key := addr.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[key] > 0 {
+		return true
+	}
+	err := l.full(hostOf(addr))
+	if err == nil {
+		return true
+	}
+	if l.rejected.Remember(addr) {
+		sessionsRejected.Inc()
+		rejectLog.Println("session rejected:", err, "in:", addr)
+	}
+	return false
+}
+
+// admitSession reserves a session for the client at addr, release frees it
+// once the session is over.
+func (l *limits) admitSession(addr net.Addr) (release func(), err error) {
+	ip, key := hostOf(addr), addr.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.full(ip); err != nil {
+		return nil, err
+	}
+	l.sessions++
+	l.perIP[ip]++
+	l.open[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.sessions--
+			if l.perIP[ip]--; l.perIP[ip] == 0 {
+				delete(l.perIP, ip)
+			}
+			if l.open[key]--; l.open[key] == 0 {
+				delete(l.open, key)
+			}
+		})
+	}, nil
+}
+
+// streamGate caps the streams of a single session.
+type streamGate struct {
+	max     int
+	open    atomic.Int64
+	limiter *rate.Limiter // nil without a rate
+}
+
+// streams returns the gate for the streams of a new session.
+func (l *limits) streams() *streamGate {
+	g := &streamGate{max: l.maxStreams}
+	if l.streamRate > 0 {
+		g.limiter = rate.NewLimiter(rate.Limit(l.streamRate), l.streamRate)
+	}
+	return g
+}
+
+// admit reserves a stream of the session, release frees it once the stream
+// is over.
+func (g *streamGate) admit() (release func(), err error) {
+	if n := g.open.Add(1); g.max > 0 && n > int64(g.max) {
+		g.open.Add(-1)
+		return nil, errors.Errorf("maxstreams reached: %d streams open", g.max)
+	}
+	if g.limiter != nil && !g.limiter.Allow() {
+		g.open.Add(-1)
+		return nil, errors.Errorf("streamrate exceeded: more than %v streams per second", g.limiter.Limit())
+	}
+	return func() { g.open.Add(-1) }, nil
+}
@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLimitsSessions(t *testing.T) {
+	l := newLimits(&Config{MaxSessions: 3, MaxSessionsPerIP: 2})
+	a1 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	c := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1000}
+
+	release, err := l.admitSession(a1)
+	if err != nil {
+		t.Fatalf("admitSession returned error: %v", err)
+	}
+	if _, err := l.admitSession(a2); err != nil {
+		t.Fatalf("admitSession returned error: %v", err)
+	}
+	if _, err := l.admitSession(a1); err == nil {
+		t.Fatal("expected a third session of the same IP to be rejected")
+	}
+	if _, err := l.admitSession(b); err != nil {
+		t.Fatalf("admitSession returned error: %v", err)
+	}
+	if _, err := l.admitSession(c); err == nil {
+		t.Fatal("expected a session over maxsessions to be rejected")
+	}
+
+	release()
+	release() // releasing twice frees a single session
+	if _, err := l.admitSession(c); err != nil {
+		t.Fatalf("admitSession returned error after a release: %v", err)
+	}
+	if _, err := l.admitSession(a1); err == nil {
+		t.Fatal("expected a session over maxsessions to be rejected")
+	}
+}
+
+func TestLimitsAdmitPacket(t *testing.T) {
+	l := newLimits(&Config{MaxSessionsPerIP: 1})
+	a1 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+
+	if !l.admitPacket(a1) {
+		t.Fatal("expected the packets of a new client under the caps to pass")
+	}
+	release, err := l.admitSession(a1)
+	if err != nil {
+		t.Fatalf("admitSession returned error: %v", err)
+	}
+	if !l.admitPacket(a1) {
+		t.Fatal("expected the packets of an open session to pass")
+	}
+
+	// A client over a cap is dropped, and counted once for all its packets.
+	rejected := sessionsRejected.Load()
+	for i := 0; i < 10; i++ {
+		if l.admitPacket(a2) {
+			t.Fatal("expected the packets of a client over maxsessionsperip to be dropped")
+		}
+	}
+	if n := sessionsRejected.Load() - rejected; n != 1 {
+		t.Fatalf("expected 1 rejection counted, got %d", n)
+	}
+
+	release()
+	if !l.admitPacket(a2) {
+		t.Fatal("expected the packets to pass once a session was released")
+	}
+}
+
+func TestLimitsStreams(t *testing.T) {
+	gate := newLimits(&Config{MaxStreams: 2}).streams()
+	release, err := gate.admit()
+	if err != nil {
+		t.Fatalf("admit returned error: %v", err)
+	}
+	if _, err := gate.admit(); err != nil {
+		t.Fatalf("admit returned error: %v", err)
+	}
+	if _, err := gate.admit(); err == nil {
+		t.Fatal("expected a stream over maxstreams to be rejected")
+	}
+	release()
+	if _, err := gate.admit(); err != nil {
+		t.Fatalf("admit returned error after a release: %v", err)
+	}
+
+	gate = newLimits(&Config{StreamRate: 3}).streams()
+	for i := 0; i < 3; i++ {
+		if _, err := gate.admit(); err != nil {
+			t.Fatalf("admit %d returned error: %v", i, err)
+		}
+	}
+	if _, err := gate.admit(); err == nil {
+		t.Fatal("expected a stream over streamrate to be rejected")
+	}
+
+	gate = newLimits(&Config{}).streams()
+	for i := 0; i < 1000; i++ {
+		if _, err := gate.admit(); err != nil {
+			t.Fatalf("admit returned error without limits: %v", err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/tcpraw"
+)
+
+const (
+	// listenRetryMin and listenRetryMax bound the delay before binding a
+	// failed listener again, doubled per failure.
+	listenRetryMin = time.Second
+	listenRetryMax = time.Minute
+)
+
+// Listener statistics, written to the SNMP log. Every listener also has a
+// "Listener:<addr>" column, 1 while it is serving and 0 while it is down.
+var (
+	listenersUp      = std.NewCounter("ListenersUp")      // listeners serving
+	listenerFailures = std.NewCounter("ListenerFailures") // failed binds and listeners failing later on
+)
+
+// portListener keeps the KCP listener of one port serving, or of the whole
+// range with port hopping: it is bound again, with a growing delay, when it
+// fails to bind or fails later on.
+type portListener struct {
+	name  string
+	bind  func() (net.PacketConn, error)
+	state *std.Counter
+
+	mu  sync.Mutex
+	lis *kcp.Listener
+}
+
+// newPortListener returns a supervisor for the listener name, whose socket
+// bind creates.
+func newPortListener(name string, bind func() (net.PacketConn, error)) *portListener {
+	p := &portListener{name: name, bind: bind, state: std.NewCounter("Listener:" + name)}
+	// A shutdown stops AcceptKCP. The listener does not own its socket,
+	// closing it leaves the sessions on the socket running.
+	std.OnShutdown(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.lis != nil {
+			p.lis.Close()
+		}
+	})
+	return p
+}
+
+// run serves conn, when already bound, then keeps binding and serving the
+// listener until the process drains. newListener wraps a socket into a KCP
+// listener, which serve accepts sessions from until it fails.
+func (p *portListener) run(conn net.PacketConn, newListener func(net.PacketConn) (*kcp.Listener, error), serve func(*kcp.Listener) error) {
+	delay := listenRetryMin
+	for !std.Draining() {
+		if conn == nil {
+			var err error
+			if conn, err = p.bind(); err != nil {
+				listenerFailures.Inc()
+				log.Println("listener:", p.name, "down:", err, "retrying in", delay)
+				time.Sleep(delay)
+				delay = min(delay*2, listenRetryMax)
+				continue
+			}
+		}
+
+		lis, err := newListener(conn)
+		if err != nil {
+			conn.Close()
+			conn = nil
+			listenerFailures.Inc()
+			log.Println("listener:", p.name, "down:", err, "retrying in", delay)
+			time.Sleep(delay)
+			delay = min(delay*2, listenRetryMax)
+			continue
+		}
+
+		log.Println("listener:", p.name, "up")
+		p.setListener(lis)
+		started := time.Now()
+		err = serve(lis)
+		p.setListener(nil)
+		if std.Draining() {
+			// The sessions on the socket carry on until the drain is over,
+			// closing it would cut them all.
+			return
+		}
+		lis.Close()
+		conn.Close()
+		conn = nil
+
+		// A listener which served a while starts over with a short delay.
+		if time.Since(started) > listenRetryMax {
+			delay = listenRetryMin
+		}
+		listenerFailures.Inc()
+		log.Println("listener:", p.name, "down:", err, "rebinding in", delay)
+		time.Sleep(delay)
+		delay = min(delay*2, listenRetryMax)
+	}
+}
+
+// setListener records lis as the listener serving, nil when down.
+func (p *portListener) setListener(lis *kcp.Listener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case lis != nil && p.lis == nil:
+		listenersUp.Inc()
+		p.state.Store(1)
+	case lis == nil && p.lis != nil:
+		listenersUp.Dec()
+		p.state.Store(0)
+	}
+	p.lis = lis
+	if lis != nil && std.Draining() { // shut down while it was bound
+		lis.Close()
+	}
+}
+
+// udpSocket returns a function binding the UDP port listenAddr, wrapped by
+// migrate to follow migrating clients when set.
+func udpSocket(listenAddr string, migrate func(net.PacketConn) net.PacketConn) func() (net.PacketConn, error) {
+	return func() (net.PacketConn, error) {
+		udpaddr, err := net.ResolveUDPAddr("udp", listenAddr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn, err := net.ListenUDP("udp", udpaddr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if migrate != nil {
+			return migrate(conn), nil
+		}
+		return conn, nil
+	}
+}
+
+// tcpSocket returns a function binding the emulated TCP port listenAddr.
+func tcpSocket(listenAddr string) func() (net.PacketConn, error) {
+	return func() (net.PacketConn, error) {
+		conn, err := tcpraw.Listen("tcp", listenAddr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return conn, nil
+	}
+}
+
+// hopConn binds the UDP ports of a range for port hopping and joins them,
+// wrapped by migrate to follow migrating clients when set. The ports
+// left out are bound again in the background and join the range once
+// bound, it returns how many were bound from the start.
+func hopConn(name string, sockets []func() (net.PacketConn, error), migrate func(net.PacketConn) net.PacketConn) (net.PacketConn, int, error) {
+	socks, missing, err := bindAll(name, sockets)
+	if err != nil {
+		return nil, 0, err
+	}
+	mc := std.NewMultiPortConn(socks)
+	for _, bind := range missing {
+		go rejoin(name, bind, mc)
+	}
+	var conn net.PacketConn = mc
+	if migrate != nil {
+		conn = migrate(conn)
+	}
+	return conn, len(socks), nil
+}
+
+// rejoin keeps binding a port of the range name which was left out, with a
+// growing delay, until it joins mc or mc is closed.
+func rejoin(name string, bind func() (net.PacketConn, error), mc *std.MultiPortConn) {
+	delay := listenRetryMin
+	for {
+		select {
+		case <-time.After(delay):
+		case <-mc.Done():
+			return
+		}
+		if std.Draining() {
+			return
+		}
+		conn, err := bind()
+		if err != nil {
+			listenerFailures.Inc()
+			delay = min(delay*2, listenRetryMax)
+			log.Println("listener:", name, "port still left out:", err, "retrying in", delay)
+			continue
+		}
+		if err := mc.Add(conn); err != nil { // the range failed meanwhile
+			conn.Close()
+			return
+		}
+		log.Println("listener:", name, "port joined:", conn.LocalAddr())
+		return
+	}
+}
+
+// bindAll binds every socket of sockets, the ones failing are left out and
+// returned as missing. It fails unless at least one of them could be bound.
+func bindAll(name string, sockets []func() (net.PacketConn, error)) (conns []net.PacketConn, missing []func() (net.PacketConn, error), err error) {
+	for _, bind := range sockets {
+		conn, err := bind()
+		if err != nil {
+			listenerFailures.Inc()
+			log.Println("listener:", name, "port left out:", err)
+			missing = append(missing, bind)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, nil, errors.Errorf("no port of %v could be bound", name)
+	}
+	return conns, missing, nil
+}
@@ -0,0 +1,209 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestBindAllLeavesOutFailedPorts(t *testing.T) {
+	failing := func() (net.PacketConn, error) { return nil, errors.New("address in use") }
+
+	conns, missing, err := bindAll("test", []func() (net.PacketConn, error){failing, udpSocket("127.0.0.1:0", nil), failing})
+	if err != nil {
+		t.Fatalf("bindAll returned error: %v", err)
+	}
+	defer conns[0].Close()
+	if len(conns) != 1 || len(missing) != 2 {
+		t.Fatalf("expected 1 bound and 2 missing ports, got %d and %d", len(conns), len(missing))
+	}
+
+	if _, _, err := bindAll("test", []func() (net.PacketConn, error){failing}); err == nil {
+		t.Fatal("expected error when no port could be bound")
+	}
+}
+
+func TestHopConnRejoinsFailedPorts(t *testing.T) {
+	late, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	binds := 0
+	flaky := func() (net.PacketConn, error) {
+		if binds++; binds == 1 {
+			return nil, errors.New("address in use")
+		}
+		return late, nil
+	}
+
+	conn, bound, err := hopConn("test", []func() (net.PacketConn, error){udpSocket("127.0.0.1:0", nil), flaky}, nil)
+	if err != nil {
+		t.Fatalf("hopConn returned error: %v", err)
+	}
+	defer conn.Close()
+	if bound != 1 {
+		t.Fatalf("expected 1 bound port, got %d", bound)
+	}
+
+	// The port left out joins the range once it can be bound.
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	defer client.Close()
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 1500)
+		n, _, _ := conn.ReadFrom(buf)
+		read <- string(buf[:n])
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		client.WriteTo([]byte("ping"), late.LocalAddr())
+		select {
+		case got := <-read:
+			if got != "ping" {
+				t.Fatalf("read %q, want ping", got)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("the port left out did not join the range")
+		}
+	}
+}
+
+func TestPortListenerRebinds(t *testing.T) {
+	binds := 0
+	bind := func() (net.PacketConn, error) {
+		if binds++; binds == 1 {
+			return nil, errors.New("address in use")
+		}
+		return udpSocket("127.0.0.1:0", nil)()
+	}
+	p := newPortListener("test/udp", bind)
+
+	failures, up := listenerFailures.Load(), listenersUp.Load()
+	serving := make(chan struct{})
+	serves := 0
+	serve := func(lis *kcp.Listener) error {
+		if serves++; serves == 1 {
+			return errors.New("socket failed")
+		}
+		close(serving)
+		select {} // keep serving until the test binary exits
+	}
+	newListener := func(conn net.PacketConn) (*kcp.Listener, error) {
+		return kcp.ServeConn(nil, 0, 0, conn)
+	}
+	go p.run(nil, newListener, serve)
+
+	select {
+	case <-serving:
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener was not bound again")
+	}
+	if binds != 3 {
+		t.Fatalf("expected 3 binds, got %d", binds)
+	}
+	if n := listenerFailures.Load() - failures; n != 2 {
+		t.Fatalf("expected 2 failures counted, got %d", n)
+	}
+	if n := listenersUp.Load() - up; n != 1 {
+		t.Fatalf("expected 1 more listener up, got %d", n)
+	}
+	if p.state.Load() != 1 {
+		t.Fatal("expected the listener state to be up")
+	}
+}
+
+func TestPortListenerDrainKeepsSessions(t *testing.T) {
+	// A drain cannot be undone, it runs in a process of its own.
+	if os.Getenv("KCPTUN_TEST_DRAIN") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPortListenerDrainKeepsSessions$")
+		cmd.Env = append(os.Environ(), "KCPTUN_TEST_DRAIN=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("drain test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	p := newPortListener("drain/udp", udpSocket("127.0.0.1:0", nil))
+	conn, err := p.bind()
+	if err != nil {
+		t.Fatalf("bind returned error: %v", err)
+	}
+	newListener := func(conn net.PacketConn) (*kcp.Listener, error) {
+		return kcp.ServeConn(nil, 0, 0, conn)
+	}
+	serve := func(lis *kcp.Listener) error {
+		for {
+			s, err := lis.AcceptKCP()
+			if err != nil {
+				return err
+			}
+			go io.Copy(s, s)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		p.run(conn, newListener, serve)
+		close(stopped)
+	}()
+
+	client, err := kcp.DialWithOptions(conn.LocalAddr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatalf("DialWithOptions returned error: %v", err)
+	}
+	defer client.Close()
+	echo := func(msg string) {
+		t.Helper()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != msg {
+			t.Fatalf("read %q, %v, want %q", buf, err, msg)
+		}
+	}
+	echo("before")
+
+	go std.Drain()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener did not stop on the drain")
+	}
+
+	// The open session keeps carrying data while the drain goes on.
+	echo("after")
+}
@@ -33,6 +33,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -43,7 +44,6 @@ import (
 	"github.com/xtaci/kcptun/std"
 	"github.com/xtaci/qpp"
 	"github.com/xtaci/smux"
-	"github.com/xtaci/tcpraw"
 )
 
 const (
@@ -54,8 +54,15 @@ const (
 )
 
 const (
-	TGT_UNIX = iota
-	TGT_TCP
+	// dialTimeout prevents indefinite hanging when a target is unreachable.
+	dialTimeout = 10 * time.Second
+	// headerTimeout is the default of -headertimeout, how long a stream may
+	// stay silent before it is treated as a legacy stream without a
+	// destination header. Clients write the header right behind the SYN of
+	// the stream, so it only comes later when its packet was lost, while a
+	// legacy client of a server-first protocol, eg: SSH, waits for that long
+	// on every connection.
+	headerTimeout = 300 * time.Millisecond
 )
 
 // VERSION is populated via build flags when packaging official binaries.
@@ -82,6 +89,83 @@ func main() {
 			Value: "127.0.0.1:12948",
 			Usage: "target server address, or path/to/unix_socket",
 		},
+		cli.StringSliceFlag{
+			Name:  "targets",
+			Usage: "balance the default target over these backends instead, host:port or path/to/unix_socket, repeatable",
+		},
+		cli.StringFlag{
+			Name:  "balance",
+			Value: "rr",
+			Usage: "how streams are spread over -targets: rr, leastconn, hash (by client IP)",
+		},
+		cli.IntFlag{
+			Name:  "healthcheck",
+			Value: 5,
+			Usage: "seconds between TCP health checks of -targets, 0 to disable",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxyprotocol",
+			Usage: `send a PROXY protocol header with the client address to the targets matching a pattern of -allowtarget, eg: "127.0.0.1:80=v1", "10.0.0.0/8:*=v2", repeatable`,
+		},
+		cli.IntFlag{
+			Name:  "headertimeout",
+			Value: int(headerTimeout / time.Millisecond),
+			Usage: "milliseconds a stream may stay silent before it is taken for one of an older client, without a destination header, raise it on lossy links with a high RTT",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowtarget",
+			Usage: `allow clients to request this destination per stream, eg: "10.0.0.1:22", "*.lan:443", "10.0.0.0/8:*", repeatable`,
+		},
+		cli.BoolFlag{
+			Name:  "udp",
+			Usage: "accept UDP streams from clients, forwarded to the UDP service at target or an allowed destination",
+		},
+		cli.BoolFlag{
+			Name:  "porthop",
+			Usage: "let sessions move between the ports of the listen range, for clients with -porthop",
+		},
+		cli.IntFlag{
+			Name:  "minports",
+			Value: 1,
+			Usage: "start when at least this many ports of the listen range could be bound, the others are retried in the background, 0 to require all",
+		},
+		cli.BoolFlag{
+			Name:  "migrate",
+			Usage: "let sessions follow their clients to a new address, clients without -migrate are still served",
+		},
+		cli.BoolFlag{
+			Name:  "redundant",
+			Usage: "accept redundant streams, sent by clients over several sessions at once",
+		},
+		cli.IntFlag{
+			Name:  "resume",
+			Value: 0,
+			Usage: "keep resumable streams for this many seconds after their session died, waiting for the client to reconnect, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "maxsessions",
+			Value: 0,
+			Usage: "close new sessions while this many are open, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "maxsessionsperip",
+			Value: 0,
+			Usage: "close new sessions of a client IP while it has this many open, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "maxstreams",
+			Value: 0,
+			Usage: "close new streams of a session while it has this many open, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "streamrate",
+			Value: 0,
+			Usage: "close the streams a session opens beyond this many per second, 0 for no limit",
+		},
+		cli.StringSliceFlag{
+			Name:  "reverse",
+			Usage: `expose a service of the clients registering this reverse tunnel name on a local address, eg: "ssh=:2222", repeatable`,
+		},
 		cli.StringFlag{
 			Name:   "key",
 			Value:  "it's a secrect",
@@ -207,6 +291,24 @@ func main() {
 			Value: 30,
 			Usage: "the seconds to wait before tearing down a connection",
 		},
+		cli.IntFlag{
+			Name:  "drain",
+			Value: std.EXIT_WAIT,
+			Usage: "on SIGTERM, stop accepting and give the open streams this many seconds to finish before exiting",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowip",
+			Usage: `only accept sessions from this IP or CIDR range, eg: "10.0.0.0/8", repeatable`,
+		},
+		cli.StringSliceFlag{
+			Name:  "denyip",
+			Usage: `refuse sessions from this IP or CIDR range, over -allowip, repeatable`,
+		},
+		cli.StringFlag{
+			Name:  "aclfile",
+			Value: "",
+			Usage: "read more -allowip and -denyip rules from this file, as lines of \"allow CIDR\" or \"deny CIDR\", it is read again once it changed",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -244,6 +346,23 @@ func main() {
 		config := Config{}
 		config.Listen = c.String("listen")
 		config.Target = c.String("target")
+		config.Targets = c.StringSlice("targets")
+		config.Balance = c.String("balance")
+		config.HealthCheck = c.Int("healthcheck")
+		config.AllowTargets = c.StringSlice("allowtarget")
+		config.HeaderTimeout = c.Int("headertimeout")
+		config.ProxyProtocol = c.StringSlice("proxyprotocol")
+		config.UDP = c.Bool("udp")
+		config.Redundant = c.Bool("redundant")
+		config.PortHop = c.Bool("porthop")
+		config.Migrate = c.Bool("migrate")
+		config.MinPorts = c.Int("minports")
+		config.Resume = c.Int("resume")
+		config.MaxSessions = c.Int("maxsessions")
+		config.MaxSessionsPerIP = c.Int("maxsessionsperip")
+		config.MaxStreams = c.Int("maxstreams")
+		config.StreamRate = c.Int("streamrate")
+		config.Reverse = c.StringSlice("reverse")
 		config.Key = c.String("key")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
@@ -275,6 +394,11 @@ func main() {
 		config.QPP = c.Bool("QPP")
 		config.QPPCount = c.Int("QPPCount")
 		config.CloseWait = c.Int("closewait")
+		config.Drain = c.Int("drain")
+		config.AllowIP = c.StringSlice("allowip")
+		config.DenyIP = c.StringSlice("denyip")
+		config.ACLFile = c.String("aclfile")
+		flags := config
 
 		if c.String("c") != "" {
 			// Currently only JSON configuration files are supported.
@@ -289,19 +413,29 @@ func main() {
 
 		// Redirect logs when the user supplied a dedicated log file.
 		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+			checkError(std.OpenLog(config.Log))
 		}
 
 		// Apply mode presets using the shared configuration helper.
 		config.ApplyMode()
+		loaded := config
 
 		log.Println("version:", VERSION)
 		log.Println("smux version:", config.SmuxVer)
 		log.Println("listening on:", config.Listen)
+		log.Println("porthop:", config.PortHop)
+		log.Println("migrate:", config.Migrate)
+		log.Println("minports:", config.MinPorts)
 		log.Println("target:", config.Target)
+		log.Println("targets:", config.Targets, "balance:", config.Balance, "healthcheck:", config.HealthCheck)
+		log.Println("allowtargets:", config.AllowTargets, "headertimeout:", config.HeaderTimeout)
+		log.Println("proxyprotocol:", config.ProxyProtocol)
+		log.Println("udp:", config.UDP)
+		log.Println("redundant:", config.Redundant)
+		log.Println("resume:", config.Resume)
+		log.Println("maxsessions:", config.MaxSessions, "maxsessionsperip:", config.MaxSessionsPerIP)
+		log.Println("maxstreams:", config.MaxStreams, "streamrate:", config.StreamRate)
+		log.Println("reverse:", config.Reverse)
 		log.Println("encryption:", config.Crypt)
 		log.Println("QPP:", config.QPP)
 		log.Println("QPP Count:", config.QPPCount)
@@ -322,6 +456,8 @@ func main() {
 		log.Println("snmpperiod:", config.SnmpPeriod)
 		log.Println("pprof:", config.Pprof)
 		log.Println("quiet:", config.Quiet)
+		log.Println("drain:", config.Drain)
+		log.Println("allowip:", config.AllowIP, "denyip:", config.DenyIP, "aclfile:", config.ACLFile)
 		log.Println("tcp:", config.TCP)
 
 		if config.QPP {
@@ -338,6 +474,51 @@ func main() {
 			log.Fatal("unsupported smux version:", config.SmuxVer)
 		}
 
+		// Compile the per-stream destination allowlist.
+		rt := new(router)
+		rt.config.Store(&config)
+		var err error
+		rt.allow, err = parseTargetAllowlist(config.AllowTargets)
+		checkError(err)
+
+		// Compile the reverse tunnels served on behalf of clients.
+		reverseRules, err := std.ParseReverseRules(config.Reverse)
+		checkError(err)
+		rt.reverse = newReverseRegistry(reverseRules)
+		rt.groups = newGroupRegistry()
+		rt.resumes = newResumeRegistry(time.Duration(config.Resume) * time.Second)
+		rt.limits = newLimits(&config)
+
+		// Balance the default target over the backends, when given.
+		if len(config.Targets) > 0 {
+			rt.lb, err = newBalancer(config.Targets, config.Balance)
+			checkError(err)
+			if config.HealthCheck > 0 {
+				interval := time.Duration(config.HealthCheck) * time.Second
+				go rt.lb.healthCheck(interval, min(interval, dialTimeout))
+			}
+		}
+
+		// Decide which targets are told the client address.
+		rt.proxy, err = parseProxyRules(config.ProxyProtocol)
+		checkError(err)
+
+		// Admit clients by their IP.
+		rt.acl, err = std.NewACL(config.AllowIP, config.DenyIP, config.ACLFile)
+		checkError(err)
+
+		// Re-read the config file on SIGHUP.
+		if path := c.String("c"); path != "" {
+			r := &reloader{path: path, flags: flags, loaded: loaded, rt: rt}
+			std.OnReload(func() {
+				if err := r.reload(); err != nil {
+					log.Println("reload:", err)
+				}
+			})
+		} else {
+			std.OnReload(func() { log.Println("reload: no config file given with -c") })
+		}
+
 		// Derive the shared session key from the pre-shared secret.
 		log.Println("initiating key derivation")
 		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
@@ -345,6 +526,8 @@ func main() {
 		block, effectiveCrypt := std.SelectBlockCrypt(config.Crypt, pass)
 		config.Crypt = effectiveCrypt
 
+		std.SetDrainTimeout(time.Duration(config.Drain) * time.Second)
+
 		// Start the SNMP logger if the feature is enabled.
 		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
 
@@ -366,6 +549,12 @@ func main() {
 		// Spawn an accept loop per listener and track each goroutine via WaitGroup.
 		var wg sync.WaitGroup
 
+		// Listen for connections to be carried back to the clients.
+		for name := range reverseRules {
+			wg.Add(1)
+			go serveReverse(name, rt.reverse, _Q_, &config, &wg)
+		}
+
 		// Parse the listen address which may contain a port range.
 		mp, err := std.ParseMultiPort(config.Listen)
 		if err != nil {
@@ -373,39 +562,131 @@ func main() {
 			return err
 		}
 
+		// Every listener runs under a supervisor binding it again after
+		// failures, see portListener.
+		newListener := func(conn net.PacketConn) (*kcp.Listener, error) {
+			// Clients refused by the ACL or over the session caps are
+			// dropped before kcp-go sets up a session for them. Without
+			// any, a bare UDP socket keeps the batched I/O of kcp-go.
+			if rt.acl != nil || config.MaxSessions > 0 || config.MaxSessionsPerIP > 0 {
+				conn = std.NewAdmitConn(conn, rt.admitPacket)
+			}
+			return kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+		}
+		serve := func(lis *kcp.Listener) error {
+			return serveListener(lis, _Q_, rt, &config)
+		}
+		start := func(p *portListener, conn net.PacketConn) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.run(conn, newListener, serve)
+			}()
+		}
+
+		// Sessions follow migrating clients with the key of the config.
+		var migrate func(net.PacketConn) net.PacketConn
+		if config.Migrate {
+			migrate = func(conn net.PacketConn) net.PacketConn {
+				return std.NewMigrateConn(conn, []byte(config.Key), block)
+			}
+		}
+
+		// With port hopping, the UDP ports of the range share one listener
+		// so a session is known on every port.
+		hop := config.PortHop && mp.MaxPort > mp.MinPort
+		var hopSockets []func() (net.PacketConn, error)
+		var units []*portListener
+		var conns []net.PacketConn
+		bound, total := 0, int(mp.MaxPort-mp.MinPort+1)
+
 		// Create listeners for every port inside the configured range.
 		for port := mp.MinPort; port <= mp.MaxPort; port++ {
 			listenAddr := fmt.Sprintf("%v:%v", mp.Host, port)
 			if config.TCP { // optionally expose a tcpraw listener alongside UDP
-				if conn, err := tcpraw.Listen("tcp", listenAddr); err == nil {
+				p := newPortListener(listenAddr+"/tcp", tcpSocket(listenAddr))
+				conn, err := p.bind()
+				if err == nil {
 					log.Printf("Listening on: %v/tcp", listenAddr)
-					lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
-					checkError(err)
-					wg.Add(1)
-					go serveListener(lis, _Q_, &config, &wg)
-				} else {
-					log.Println(err)
 				}
+				units, conns = append(units, p), append(conns, conn)
 			}
 
 			// Always stand up the UDP listener; this is the default transport.
-			log.Printf("Listening on: %v/udp", listenAddr)
-			lis, err := kcp.ListenWithOptions(listenAddr, block, config.DataShard, config.ParityShard)
-			checkError(err)
-			wg.Add(1)
-			go serveListener(lis, _Q_, &config, &wg)
+			if hop {
+				hopSockets = append(hopSockets, udpSocket(listenAddr, nil))
+				continue
+			}
+			p := newPortListener(listenAddr+"/udp", udpSocket(listenAddr, migrate))
+			conn, err := p.bind()
+			if err == nil {
+				log.Printf("Listening on: %v/udp", listenAddr)
+				bound++
+			}
+			units, conns = append(units, p), append(conns, conn)
+		}
+
+		if hop {
+			name := fmt.Sprintf("%v:%v-%v/udp", mp.Host, mp.MinPort, mp.MaxPort)
+			p := newPortListener(name, func() (net.PacketConn, error) {
+				conn, _, err := hopConn(name, hopSockets, migrate)
+				return conn, err
+			})
+			// The first time, the bound ports are counted.
+			conn, n, err := hopConn(name, hopSockets, migrate)
+			if err == nil {
+				log.Printf("Listening on: %v", name)
+				bound = n
+			}
+			units, conns = append(units, p), append(conns, conn)
+		}
+
+		// Go on with part of the range, the ports left out are bound again
+		// in the background.
+		minPorts := config.MinPorts
+		if minPorts <= 0 || minPorts > total {
+			minPorts = total
+		}
+		log.Println("listening on", bound, "of", total, "udp ports, at least", minPorts, "required")
+		if bound < minPorts {
+			log.Fatalf("only %v of %v udp ports could be bound, minports is %v", bound, total, minPorts)
+		}
+		for i, p := range units {
+			start(p, conns[i])
 		}
 
 		wg.Wait()
+		if std.Draining() {
+			select {} // the drain exits once the streams are done
+		}
 		return nil
 	}
 	myApp.Run(os.Args)
 }
 
+// router holds everything deciding where the streams of a session go.
+type router struct {
+	allow   targetAllowlist  // destinations clients may request
+	reverse *reverseRegistry // sessions serving reverse tunnels
+	lb      *balancer        // backends of the default target, if any
+	proxy   proxyRules       // targets told the client address
+	groups  *groupRegistry   // legs of redundant streams being joined
+	resumes *resumeRegistry  // resumable streams, by id
+	limits  *limits          // caps on the sessions and streams of clients
+	acl     *std.ACL         // clients admitted by IP, nil for everyone
+
+	config atomic.Pointer[Config] // the running config, replaced by reloads
+}
+
+// admitPacket lets the packets of a client reach kcp-go when the ACL admits
+// it and its session is within the caps, see std.AdmitConn.
+func (rt *router) admitPacket(addr net.Addr) bool {
+	return rt.acl.Admit(addr) && rt.limits.admitPacket(addr)
+}
+
 // serveListener drains incoming KCP conversations from lis and dispatches each
-// one to handleMux while keeping wg accounting balanced.
-func serveListener(lis *kcp.Listener, _Q_ *qpp.QuantumPermutationPad, config *Config, wg *sync.WaitGroup) {
-	defer wg.Done()
+// one to handleMux. It returns once lis failed, or stopped for a shutdown.
+func serveListener(lis *kcp.Listener, _Q_ *qpp.QuantumPermutationPad, rt *router, config *Config) error {
 	if err := lis.SetDSCP(config.DSCP); err != nil {
 		log.Println("SetDSCP:", err)
 	}
@@ -421,34 +702,43 @@ func serveListener(lis *kcp.Listener, _Q_ *qpp.QuantumPermutationPad, config *Co
 	for {
 		conn, err := lis.AcceptKCP()
 		if err != nil {
-			log.Printf("%+v", err)
+			if std.Draining() {
+				return nil
+			}
+			// The socket failed, the listener must be bound again.
+			return err
+		}
+		// Sessions set up meanwhile by other clients may fill the caps.
+		release, err := rt.limits.admitSession(conn.RemoteAddr())
+		if err != nil {
+			sessionsRejected.Inc()
+			rejectLog.Println("session rejected:", err, "in:", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
 		log.Println("remote address:", conn.RemoteAddr())
 		conn.SetStreamMode(true)
 		conn.SetWriteDelay(false)
-		conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-		conn.SetMtu(config.MTU)
-		conn.SetWindowSize(config.SndWnd, config.RcvWnd)
-		conn.SetACKNoDelay(config.AckNodelay)
-		conn.SetRateLimit(uint32(config.RateLimit))
-
-		if config.NoComp {
-			go handleMux(_Q_, conn, config)
-		} else {
-			go handleMux(_Q_, std.NewCompStream(conn), config)
-		}
+		untrack := config.TuneKCP(conn)
+
+		go func() {
+			defer release()
+			defer untrack()
+			if config.NoComp {
+				handleMux(_Q_, conn, rt, config)
+			} else {
+				handleMux(_Q_, std.NewCompStream(conn), rt, config)
+			}
+		}()
 	}
 }
 
 // handleMux drives a single KCP session: it accepts smux streams and forwards
-// each stream to the configured TCP or UNIX target.
-func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, config *Config) {
-	// Determine whether the upstream target is TCP or a UNIX socket path.
-	targetType := TGT_TCP
-	if _, _, err := net.SplitHostPort(config.Target); err != nil {
-		targetType = TGT_UNIX
-	}
+// each stream to the configured TCP or UNIX target, or to the destination
+// requested in the stream header when allowed by rt. Streams registering a
+// reverse tunnel make the session available to rt.reverse. When rt.lb is set,
+// streams for the default target are balanced over its backends instead.
+func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, rt *router, config *Config) {
 	log.Println("smux version:", config.SmuxVer, "on connection:", conn.LocalAddr(), "->", conn.RemoteAddr())
 
 	smuxConfig, err := std.BuildSmuxConfig(
@@ -471,59 +761,211 @@ func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, config *Config) {
 		return
 	}
 	defer mux.Close()
+	defer std.TrackSession(mux)()
 
 	// Accept and handle smux streams until the session terminates.
+	gate := rt.limits.streams()
 	for {
 		stream, err := mux.AcceptStream()
 		if err != nil {
 			log.Println(err)
 			return
 		}
+		// A draining server lets the open streams finish but takes no more.
+		if std.Draining() {
+			stream.Close()
+			continue
+		}
+		release, err := gate.admit()
+		if err != nil {
+			streamsRejected.Inc()
+			rejectLog.Println("stream rejected:", err, "in:", fmt.Sprintf("%v(%d)", stream.RemoteAddr(), stream.ID()))
+			stream.Close()
+			continue
+		}
 
 		go func(p1 *smux.Stream) {
+			defer release()
+			// Streams follow the config of the last reload.
+			config := rt.config.Load()
+
+			// Determine whether the upstream target is TCP or a UNIX socket path.
+			network := "tcp"
+			if _, _, err := net.SplitHostPort(config.Target); err != nil {
+				network = "unix"
+			}
+			addr := config.Target
+
+			// Streams only carry a destination header when a feature relying
+			// on it is enabled, otherwise every stream goes to the default target.
+			var hdr *std.Header
+			var prefix []byte
+			if config.acceptsHeaders() {
+				var err error
+				hdr, prefix, err = std.ProbeHeader(p1, time.Duration(config.HeaderTimeout)*time.Millisecond)
+				if err != nil {
+					log.Println("header:", err, "in:", p1.RemoteAddr())
+					p1.Close()
+					return
+				}
+			}
+
+			if hdr != nil && hdr.Network == std.NetworkReverse {
+				handleRegistration(rt.reverse, mux, p1, hdr.Addr)
+				return
+			}
+
+			if hdr != nil {
+				var err error
+				if network, addr, err = resolveTarget(hdr, network, rt.allow, config); err != nil {
+					log.Println(err, "in:", p1.RemoteAddr())
+					std.WriteReply(p1, std.ReplyNotAllowed)
+					p1.Close()
+					return
+				}
+			}
+
+			// A new leg of a resumable stream replaces the one it lost.
+			if hdr != nil && hdr.Reattach {
+				rc := rt.resumes.lookup(hdr.Resume)
+				if rc == nil {
+					log.Println("resumable stream unknown or expired", "in:", p1.RemoteAddr())
+					std.WriteReply(p1, std.ReplyFailure)
+					p1.Close()
+					return
+				}
+				if err := std.WriteReply(p1, std.ReplyOK); err != nil {
+					p1.Close()
+					return
+				}
+				if err := rc.Attach(wrapLeg(_Q_, []byte(config.Key), p1, nil, hdr.Comp)); err != nil {
+					log.Println("resume:", err, "in:", p1.RemoteAddr())
+					return
+				}
+				log.Println("stream resumed", "in:", fmt.Sprintf("%v(%d)", p1.RemoteAddr(), p1.ID()))
+				return
+			}
+
+			// The legs of a redundant stream are served by the first one.
+			legs := []*smux.Stream{p1}
+			if hdr != nil && hdr.Group != "" {
+				if legs = rt.groups.join(hdr.Group, hdr.Legs, p1); legs == nil {
+					return
+				}
+			}
+
+			// The addresses a backend is told about, which also identify the
+			// client for hash balancing.
+			src, dst := proxyAddrs(hdr, p1)
+
 			var p2 net.Conn
 			var err error
-
-			// Use timeout to prevent indefinite hanging when target is unreachable
-			const dialTimeout = 10 * time.Second
-			switch targetType {
-			case TGT_TCP:
-				p2, err = net.DialTimeout("tcp", config.Target, dialTimeout)
-			case TGT_UNIX:
-				p2, err = net.DialTimeout("unix", config.Target, dialTimeout)
+			dialed := addr
+			if rt.lb != nil && network != "udp" && addr == config.Target {
+				// Clients are told apart by IP, the port changes with every session.
+				p2, err = rt.lb.dial(src.Addr().String(), dialTimeout)
+				if err == nil {
+					dialed = p2.(*backendConn).backend.addr
+				}
+			} else {
+				p2, err = net.DialTimeout(network, addr, dialTimeout)
+			}
+			if hdr != nil {
+				// Let the client know how the dial went before any payload,
+				// dropping the legs which cannot be told.
+				var werr error
+				alive := legs[:0]
+				for _, leg := range legs {
+					if werr = std.WriteReply(leg, std.ReplyCode(err)); werr != nil {
+						leg.Close()
+						continue
+					}
+					alive = append(alive, leg)
+				}
+				if legs = alive; len(legs) == 0 && err == nil {
+					p2.Close()
+					err = werr
+				}
 			}
 
 			if err != nil {
 				log.Println(err)
-				p1.Close()
+				for _, leg := range legs {
+					leg.Close()
+				}
 				return
 			}
-			handleClient(_Q_, []byte(config.Key), p1, p2, config.Quiet, config.CloseWait)
+
+			if network == "udp" {
+				handleDatagrams(_Q_, []byte(config.Key), p1, p2, config.Quiet)
+			} else {
+				var proxyHdr []byte
+				if version := rt.proxy.version(network, dialed); version != 0 {
+					proxyHdr, _ = std.MarshalProxyHeader(version, src, dst)
+				}
+				comp := hdr != nil && hdr.Comp
+				var resume func(io.ReadWriteCloser) (io.ReadWriteCloser, error)
+				if hdr != nil && hdr.Resume != "" {
+					id := hdr.Resume
+					resume = func(s1 io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+						return rt.resumes.open(id, s1)
+					}
+				}
+				handleClient(_Q_, []byte(config.Key), legs, prefix, comp, resume, p2, proxyHdr, config.Quiet, config.CloseWait)
+			}
 		}(stream)
 	}
 }
 
 // handleClient relays traffic between an smux stream and the upstream target
-// while optionally wrapping the smux side with QPP for obfuscation.
-func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream, p2 net.Conn, quiet bool, closeWait int) {
+// while optionally wrapping the smux side with QPP for obfuscation. prefix
+// holds the bytes consumed from p1 while probing for a header, comp is set
+// when the header asked for a compressed stream. proxyHdr, if any, is the
+// PROXY protocol header sent to p2 ahead of the payload. More than one leg
+// make a redundant stream, joined by std.DupConn. resume, if set, turns the
+// stream into a resumable one, see std.ResumeConn.
+func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, legs []*smux.Stream, prefix []byte, comp bool, resume func(io.ReadWriteCloser) (io.ReadWriteCloser, error), p2 net.Conn, proxyHdr []byte, quiet bool, closeWait int) {
 	logln := func(v ...any) {
 		if !quiet {
 			log.Println(v...)
 		}
 	}
 
-	defer p1.Close()
+	p1 := legs[0]
+	for _, leg := range legs {
+		defer leg.Close()
+	}
 	defer p2.Close()
 
 	streamID := fmt.Sprintf("%v(%d)", p1.RemoteAddr(), p1.ID())
+	if len(legs) > 1 {
+		streamID = fmt.Sprintf("%v legs:%d", streamID, len(legs))
+	}
 	logln("stream opened", "in:", streamID, "out:", p2.RemoteAddr())
 	defer logln("stream closed", "in:", streamID, "out:", p2.RemoteAddr())
 
-	var s1, s2 io.ReadWriteCloser = p1, p2
-	// Optionally wrap the smux side with QPP obfuscation.
-	if _Q_ != nil {
-		// Replace the smux side with a QPP-wrapped port.
-		s1 = std.NewQPPPort(p1, _Q_, seed)
+	var s1, s2 io.ReadWriteCloser = wrapLeg(_Q_, seed, p1, prefix, comp), p2
+	if len(legs) > 1 {
+		wrapped := make([]io.ReadWriteCloser, len(legs))
+		for i, leg := range legs {
+			wrapped[i] = wrapLeg(_Q_, seed, leg, prefix, comp)
+		}
+		s1 = std.NewDupConn(wrapped)
+	}
+	if resume != nil {
+		var err error
+		if s1, err = resume(s1); err != nil {
+			logln("resume:", err, "in:", streamID, "out:", p2.RemoteAddr())
+			return
+		}
+	}
+
+	// Tell the target who the client is before any of its payload.
+	if len(proxyHdr) > 0 {
+		if _, err := p2.Write(proxyHdr); err != nil {
+			logln("proxy protocol:", err, "in:", streamID, "out:", p2.RemoteAddr())
+			return
+		}
 	}
 
 	// Begin piping data bidirectionally between the upstream and downstream ends.
@@ -538,6 +980,57 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream,
 	}
 }
 
+// wrapLeg applies the per stream layers to an smux stream: prefix holds the
+// bytes consumed while probing for a header, comp is set when the header
+// asked for a compressed stream.
+func wrapLeg(_Q_ *qpp.QuantumPermutationPad, seed []byte, leg *smux.Stream, prefix []byte, comp bool) io.ReadWriteCloser {
+	var conn net.Conn = leg
+	// Replay the bytes read while probing for a header.
+	if len(prefix) > 0 {
+		conn = std.NewPrefixConn(leg, prefix)
+	}
+
+	// Decompress the stream below QPP, as done for whole sessions.
+	var s1 io.ReadWriteCloser = conn
+	if comp {
+		s1 = std.NewCompStream(conn)
+	}
+
+	// Optionally wrap the smux side with QPP obfuscation.
+	if _Q_ != nil {
+		// Replace the smux side with a QPP-wrapped port.
+		s1 = std.NewQPPPort(s1, _Q_, seed)
+	}
+	return s1
+}
+
+// handleDatagrams relays length-prefixed datagrams between an smux stream and
+// a connected UDP socket to the target.
+func handleDatagrams(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream, p2 net.Conn, quiet bool) {
+	logln := func(v ...any) {
+		if !quiet {
+			log.Println(v...)
+		}
+	}
+
+	streamID := fmt.Sprintf("%v(%d)", p1.RemoteAddr(), p1.ID())
+	logln("udp stream opened", "in:", streamID, "out:", p2.RemoteAddr())
+	defer logln("udp stream closed", "in:", streamID, "out:", p2.RemoteAddr())
+
+	var s1 io.ReadWriteCloser = p1
+	if _Q_ != nil {
+		s1 = std.NewQPPPort(p1, _Q_, seed)
+	}
+
+	err1, err2 := std.PipeDatagrams(s1, p2)
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		logln("pipe:", err1, "in:", streamID, "out:", p2.RemoteAddr())
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		logln("pipe:", err2, "in:", streamID, "out:", p2.RemoteAddr())
+	}
+}
+
 // checkError logs the supplied fatal error and terminates the process.
 func checkError(err error) {
 	if err != nil {
@@ -0,0 +1,83 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// TestLegacyStreamLatency pins how long a stream of an older client waits
+// for a server-first target, eg: SSH, while the server probes for a header.
+func TestLegacyStreamLatency(t *testing.T) {
+	banner := "SSH-2.0-OpenSSH\r\n"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+
+	config := Config{Target: ln.Addr().String(), AllowTargets: []string{"10.0.0.1:22"}, HeaderTimeout: int(headerTimeout / time.Millisecond)}
+	config.SmuxVer, config.SmuxBuf, config.StreamBuf, config.FrameSize, config.KeepAlive = 1, 4194304, 2097152, 8192, 10
+	config.Quiet = true
+	rt := &router{groups: newGroupRegistry(), resumes: newResumeRegistry(0), limits: newLimits(&config)}
+	if rt.allow, err = parseTargetAllowlist(config.AllowTargets); err != nil {
+		t.Fatalf("parseTargetAllowlist returned error: %v", err)
+	}
+	rt.config.Store(&config)
+
+	c1, c2 := net.Pipe()
+	go handleMux(nil, c2, rt, &config)
+	session, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Client returned error: %v", err)
+	}
+	defer session.Close()
+
+	start := time.Now()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream returned error: %v", err)
+	}
+	defer stream.Close()
+	buf := make([]byte, len(banner))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != banner {
+		t.Fatalf("banner not relayed: %q %v", buf, err)
+	}
+	if elapsed := time.Since(start); elapsed > headerTimeout+200*time.Millisecond {
+		t.Fatalf("legacy stream waited %v for the banner, want about %v", elapsed, headerTimeout)
+	}
+}
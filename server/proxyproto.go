@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// proxyRule writes PROXY protocol headers of version to the targets matching
+// a pattern in the syntax of -allowtarget.
+type proxyRule struct {
+	match   targetAllowlist
+	version int
+}
+
+// proxyRules picks the PROXY protocol version for each dialed target.
+type proxyRules []proxyRule
+
+// parseProxyRules compiles rules written as "pattern=v1" or "pattern=v2".
+func parseProxyRules(entries []string) (proxyRules, error) {
+	rules := make(proxyRules, 0, len(entries))
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, errors.Errorf("proxyprotocol %q: expected target=v1 or target=v2", entry)
+		}
+
+		var rule proxyRule
+		switch entry[i+1:] {
+		case "v1":
+			rule.version = std.ProxyV1
+		case "v2":
+			rule.version = std.ProxyV2
+		default:
+			return nil, errors.Errorf("proxyprotocol %q: unsupported version", entry)
+		}
+
+		var err error
+		if rule.match, err = parseTargetAllowlist([]string{entry[:i]}); err != nil {
+			return nil, errors.Wrapf(err, "proxyprotocol %q", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// version returns the PROXY protocol version to write to network/addr, or 0
+// when no rule matches.
+func (r proxyRules) version(network, addr string) int {
+	for _, rule := range r {
+		if rule.match.Allowed(network, addr) {
+			return rule.version
+		}
+	}
+	return 0
+}
+
+// proxyAddrs returns the addresses announced to a backend for stream p1: the
+// client's own addresses when it sent them, the addresses of the tunnel
+// otherwise.
+func proxyAddrs(hdr *std.Header, p1 net.Conn) (src, dst netip.AddrPort) {
+	srcStr, dstStr := p1.RemoteAddr().String(), p1.LocalAddr().String()
+	if hdr != nil && hdr.Src != "" {
+		srcStr, dstStr = hdr.Src, hdr.Dst
+	}
+	// Unparsable addresses are announced as unknown.
+	src, _ = netip.ParseAddrPort(srcStr)
+	dst, _ = netip.ParseAddrPort(dstStr)
+	return src, dst
+}
@@ -0,0 +1,75 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestProxyRules(t *testing.T) {
+	rules, err := parseProxyRules([]string{"127.0.0.1:80=v1", "10.0.0.0/8:*=v2", "/run/nginx.sock=v2"})
+	if err != nil {
+		t.Fatalf("parseProxyRules returned error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		network, addr string
+		want          int
+	}{
+		{"tcp", "127.0.0.1:80", std.ProxyV1},
+		{"tcp", "127.0.0.1:81", 0},
+		{"tcp", "10.1.2.3:443", std.ProxyV2},
+		{"unix", "/run/nginx.sock", std.ProxyV2},
+	} {
+		if got := rules.version(tc.network, tc.addr); got != tc.want {
+			t.Fatalf("%v %v: got v%d want v%d", tc.network, tc.addr, got, tc.want)
+		}
+	}
+
+	for _, entry := range []string{"127.0.0.1:80", "127.0.0.1:80=v3", "10.0.0.0/33:*=v1"} {
+		if _, err := parseProxyRules([]string{entry}); err == nil {
+			t.Fatalf("expected error for %q", entry)
+		}
+	}
+}
+
+func TestProxyAddrs(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	hdr := &std.Header{Src: "192.0.2.1:5000", Dst: "198.51.100.1:443"}
+	src, dst := proxyAddrs(hdr, c1)
+	if src.String() != hdr.Src || dst.String() != hdr.Dst {
+		t.Fatalf("expected the client addresses, got %v %v", src, dst)
+	}
+
+	// net.Pipe has no IP addresses, they are announced as unknown
+	src, dst = proxyAddrs(nil, c1)
+	if src.IsValid() || dst.IsValid() {
+		t.Fatalf("expected unknown addresses, got %v %v", src, dst)
+	}
+}
@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// groupJoinTimeout bounds how long the first leg of a redundant stream
+	// waits for the others; legs arriving later are refused.
+	groupJoinTimeout = 3 * time.Second
+
+	// maxGroupLegs bounds the legs a client may ask to be waited for.
+	maxGroupLegs = 8
+)
+
+// streamGroup collects the legs of one redundant stream.
+type streamGroup struct {
+	want   int
+	legs   []*smux.Stream
+	full   chan struct{} // closed once want legs joined
+	closed bool          // the first leg stopped waiting, later legs are refused
+}
+
+// groupRegistry joins the legs of redundant streams, which usually arrive
+// on different sessions, by the group id of their headers.
+type groupRegistry struct {
+	mu     sync.Mutex
+	groups map[string]*streamGroup
+}
+
+func newGroupRegistry() *groupRegistry {
+	return &groupRegistry{groups: make(map[string]*streamGroup)}
+}
+
+// join adds p1 to the group id expecting want legs. The first leg of a group
+// waits for the others and returns every leg that joined in time, which is
+// then served as a single stream. The other legs return nil, they are handed
+// over to the first one or, when too late, refused and closed.
+func (r *groupRegistry) join(id string, want int, p1 *smux.Stream) []*smux.Stream {
+	r.mu.Lock()
+	g, ok := r.groups[id]
+	if ok {
+		defer r.mu.Unlock()
+		if g.closed {
+			std.WriteReply(p1, std.ReplyFailure)
+			p1.Close()
+			return nil
+		}
+		g.legs = append(g.legs, p1)
+		if len(g.legs) == g.want {
+			close(g.full)
+		}
+		return nil
+	}
+
+	g = &streamGroup{want: min(want, maxGroupLegs), legs: []*smux.Stream{p1}, full: make(chan struct{})}
+	r.groups[id] = g
+	r.mu.Unlock()
+
+	if g.want > 1 {
+		select {
+		case <-g.full:
+		case <-time.After(groupJoinTimeout):
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g.closed = true
+	// Keep the group around a while to refuse its late legs.
+	time.AfterFunc(groupJoinTimeout, func() {
+		r.mu.Lock()
+		delete(r.groups, id)
+		r.mu.Unlock()
+	})
+	return g.legs
+}
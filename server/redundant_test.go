@@ -0,0 +1,102 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+// newTestStream opens a stream on a session connected to a live peer, so
+// writes on it do not block.
+func newTestStream(t *testing.T) (*smux.Stream, *smux.Session) {
+	c1, c2 := net.Pipe()
+	client, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Client returned error: %v", err)
+	}
+	server, err := smux.Server(c2, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Server returned error: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream returned error: %v", err)
+	}
+	return stream, server
+}
+
+func TestGroupRegistryJoin(t *testing.T) {
+	r := newGroupRegistry()
+	leg1, _ := newTestStream(t)
+	leg2, _ := newTestStream(t)
+
+	ch := make(chan []*smux.Stream)
+	go func() { ch <- r.join("g", 2, leg1) }()
+	time.Sleep(10 * time.Millisecond)
+	if legs := r.join("g", 2, leg2); legs != nil {
+		t.Fatal("the second leg must be handed over to the first")
+	}
+
+	select {
+	case legs := <-ch:
+		if len(legs) != 2 || legs[0] != leg1 || legs[1] != leg2 {
+			t.Fatalf("got legs %v, want both in order", legs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first leg kept waiting with every leg joined")
+	}
+
+	// A leg arriving after the group was served is refused.
+	late, peer := newTestStream(t)
+	if legs := r.join("g", 2, late); legs != nil {
+		t.Fatal("late leg joined a served group")
+	}
+	accepted, err := peer.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream returned error: %v", err)
+	}
+	if code, _ := std.ReadReply(accepted); code != std.ReplyFailure {
+		t.Fatalf("late leg got reply %d, want failure", code)
+	}
+}
+
+func TestGroupRegistryTimeout(t *testing.T) {
+	r := newGroupRegistry()
+	leg, _ := newTestStream(t)
+
+	start := time.Now()
+	legs := r.join("g", 2, leg)
+	if len(legs) != 1 || legs[0] != leg {
+		t.Fatalf("got legs %v, want the lone first leg", legs)
+	}
+	if elapsed := time.Since(start); elapsed < groupJoinTimeout {
+		t.Fatalf("gave up on the missing leg after %v", elapsed)
+	}
+}
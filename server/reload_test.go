@@ -0,0 +1,60 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReloaderAppliesLiveFields(t *testing.T) {
+	path := writeTempConfig(t, `{"target": "127.0.0.1:22", "key": "secret", "quiet": false}`)
+	var config Config
+	if err := parseJSONConfig(&config, path); err != nil {
+		t.Fatalf("parseJSONConfig returned error: %v", err)
+	}
+	rt := new(router)
+	rt.config.Store(&config)
+	r := &reloader{path: path, loaded: config, rt: rt}
+
+	if err := os.WriteFile(path, []byte(`{"target": "127.0.0.1:2222", "key": "secret", "quiet": true, "ratelimit": 1000}`), 0o644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	if got := rt.config.Load(); got.Target != "127.0.0.1:2222" || !got.Quiet || got.RateLimit != 1000 {
+		t.Fatalf("live fields not applied: %+v", got)
+	}
+
+	// A single field needing a restart rejects the whole file.
+	if err := os.WriteFile(path, []byte(`{"target": "127.0.0.1:22", "key": "other", "quiet": true}`), 0o644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if err := r.reload(); err == nil || err.Error() != "key cannot change without a restart" {
+		t.Fatalf("got %v, want key rejected", err)
+	}
+	if got := rt.config.Load(); got.Target != "127.0.0.1:2222" {
+		t.Fatalf("rejected reload changed the target: %v", got.Target)
+	}
+}
@@ -0,0 +1,107 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// resumeRegistry keeps the resumable streams by the id of their headers, so
+// a client can attach a new leg to them after its session died.
+type resumeRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*std.ResumeConn
+	timeout time.Duration // how long a stream waits for a new leg
+}
+
+func newResumeRegistry(timeout time.Duration) *resumeRegistry {
+	return &resumeRegistry{streams: make(map[string]*std.ResumeConn), timeout: timeout}
+}
+
+// open starts the resumable stream id over its first leg s1.
+func (r *resumeRegistry) open(id string, s1 io.ReadWriteCloser) (*std.ResumeConn, error) {
+	rc := std.NewResumeConn()
+	r.mu.Lock()
+	if _, ok := r.streams[id]; ok {
+		r.mu.Unlock()
+		s1.Close()
+		return nil, errors.New("resumable stream id in use")
+	}
+	r.streams[id] = rc
+	r.mu.Unlock()
+
+	if err := rc.Attach(s1); err != nil {
+		r.remove(id, rc)
+		return nil, err
+	}
+	go r.watch(id, rc)
+	return rc, nil
+}
+
+// lookup returns the resumable stream id, or nil.
+func (r *resumeRegistry) lookup(id string) *std.ResumeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[id]
+}
+
+func (r *resumeRegistry) remove(id string, rc *std.ResumeConn) {
+	r.mu.Lock()
+	if r.streams[id] == rc {
+		delete(r.streams, id)
+	}
+	r.mu.Unlock()
+}
+
+// watch closes rc when no new leg was attached within the timeout of its
+// last one failing, and forgets it once closed.
+func (r *resumeRegistry) watch(id string, rc *std.ResumeConn) {
+	defer r.remove(id, rc)
+	for {
+		select {
+		case <-rc.Broken():
+		case <-rc.Done():
+			return
+		}
+
+		deadline := time.Now().Add(r.timeout)
+		for !rc.Attached() {
+			if time.Now().After(deadline) {
+				log.Println("resumable stream expired, no leg attached within", r.timeout)
+				rc.Close()
+				return
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-rc.Done():
+				return
+			}
+		}
+	}
+}
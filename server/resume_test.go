@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcptun/std"
+)
+
+func TestResumeRegistry(t *testing.T) {
+	r := newResumeRegistry(time.Second)
+	stream, server := newTestStream(t)
+	p1, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream returned error: %v", err)
+	}
+
+	peer := std.NewResumeConn()
+	defer peer.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- peer.Attach(stream) }()
+	rc, err := r.open("id", p1)
+	if err != nil {
+		t.Fatalf("open returned error: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Attach returned error: %v", err)
+	}
+
+	if r.lookup("id") != rc {
+		t.Fatal("resumable stream not registered")
+	}
+	other, _ := newTestStream(t)
+	if _, err := r.open("id", other); err == nil {
+		t.Fatal("id opened twice")
+	}
+
+	// Without a new leg the stream expires and is forgotten.
+	server.Close()
+	select {
+	case <-rc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("detached stream did not expire")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if r.lookup("id") != nil {
+		t.Fatal("expired stream still registered")
+	}
+}
@@ -0,0 +1,198 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/qpp"
+	"github.com/xtaci/smux"
+)
+
+// reverseRegistry tracks which client sessions serve each reverse tunnel.
+type reverseRegistry struct {
+	rules map[string]string // tunnel name -> server listen address
+
+	mu       sync.Mutex
+	sessions map[string][]*smux.Session
+}
+
+// newReverseRegistry creates a registry for the configured tunnels.
+func newReverseRegistry(rules map[string]string) *reverseRegistry {
+	return &reverseRegistry{
+		rules:    rules,
+		sessions: make(map[string][]*smux.Session),
+	}
+}
+
+// register records mux as serving name until the returned func is called.
+func (r *reverseRegistry) register(name string, mux *smux.Session) (unregister func(), err error) {
+	if _, ok := r.rules[name]; !ok {
+		return nil, errors.Errorf("reverse tunnel not configured: %v", name)
+	}
+
+	r.mu.Lock()
+	r.sessions[name] = append(r.sessions[name], mux)
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		list := r.sessions[name]
+		for i := range list {
+			if list[i] == mux {
+				r.sessions[name] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// pick returns the most recently registered live session serving name, so a
+// reconnected client takes over from the session it replaces.
+func (r *reverseRegistry) pick(name string) *smux.Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.sessions[name]
+	for i := len(list) - 1; i >= 0; i-- {
+		if !list[i].IsClosed() {
+			return list[i]
+		}
+	}
+	return nil
+}
+
+// handleRegistration keeps a client's registration for a reverse tunnel
+// alive until the registration stream p1 or its session goes away.
+func handleRegistration(reverse *reverseRegistry, mux *smux.Session, p1 *smux.Stream, name string) {
+	defer p1.Close()
+
+	unregister, err := reverse.register(name, mux)
+	if err != nil {
+		log.Println(err, "in:", p1.RemoteAddr())
+		std.WriteReply(p1, std.ReplyNotAllowed)
+		return
+	}
+	defer unregister()
+
+	if err := std.WriteReply(p1, std.ReplyOK); err != nil {
+		log.Println("reverse:", err, "in:", p1.RemoteAddr())
+		return
+	}
+	log.Println("reverse tunnel registered:", name, "in:", p1.RemoteAddr())
+	defer log.Println("reverse tunnel unregistered:", name, "in:", p1.RemoteAddr())
+
+	// Nothing is sent on a registration stream, it only ends with the client.
+	io.Copy(io.Discard, p1)
+}
+
+// serveReverse accepts connections on the listen address of the reverse
+// tunnel name and carries each one to the client serving it.
+func serveReverse(name string, reverse *reverseRegistry, _Q_ *qpp.QuantumPermutationPad, config *Config, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	addr := reverse.rules[name]
+	network := "tcp"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		network = "unix"
+	}
+	listener, err := net.Listen(network, addr)
+	checkError(err)
+	log.Println("reverse tunnel:", name, "listening on:", listener.Addr())
+	std.OnShutdown(func() { listener.Close() })
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if std.Draining() {
+				return
+			}
+			log.Fatalf("%+v", err)
+		}
+		go handleReverse(_Q_, []byte(config.Key), reverse, name, conn, config.Quiet, config.CloseWait)
+	}
+}
+
+// handleReverse opens a stream back to the client serving name and relays p1
+// through it.
+func handleReverse(_Q_ *qpp.QuantumPermutationPad, seed []byte, reverse *reverseRegistry, name string, p1 net.Conn, quiet bool, closeWait int) {
+	logln := func(v ...any) {
+		if !quiet {
+			log.Println(v...)
+		}
+	}
+
+	defer p1.Close()
+
+	mux := reverse.pick(name)
+	if mux == nil {
+		logln("reverse tunnel:", name, "no client registered", "in:", p1.RemoteAddr())
+		return
+	}
+
+	p2, err := mux.OpenStream()
+	if err != nil {
+		logln(err)
+		return
+	}
+	defer p2.Close()
+
+	streamID := fmt.Sprintf("%v(%d)", p2.RemoteAddr(), p2.ID())
+
+	// The header and its reply travel before QPP wraps the stream. The
+	// client answers once it has dialed its local target, a session which
+	// stays silent for longer is most likely gone.
+	p2.SetReadDeadline(time.Now().Add(dialTimeout + headerTimeout))
+	err = std.WriteHeader(p2, &std.Header{Network: std.NetworkReverse, Addr: name})
+	if err == nil {
+		_, err = std.ReadReply(p2)
+	}
+	p2.SetReadDeadline(time.Time{})
+	if err != nil {
+		logln("reverse tunnel:", name, err, "in:", p1.RemoteAddr(), "out:", streamID)
+		return
+	}
+
+	var s1, s2 io.ReadWriteCloser = p1, p2
+	if _Q_ != nil {
+		s2 = std.NewQPPPort(p2, _Q_, seed)
+	}
+
+	logln("reverse stream opened", "in:", p1.RemoteAddr(), "out:", streamID)
+	defer logln("reverse stream closed", "in:", p1.RemoteAddr(), "out:", streamID)
+
+	err1, err2 := std.Pipe(s1, s2, closeWait)
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		logln("pipe:", err1, "in:", p1.RemoteAddr(), "out:", streamID)
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		logln("pipe:", err2, "in:", p1.RemoteAddr(), "out:", streamID)
+	}
+}
@@ -0,0 +1,64 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/xtaci/kcptun/std/stdtest"
+)
+
+func TestReverseRegistry(t *testing.T) {
+	reverse := newReverseRegistry(map[string]string{"ssh": ":2222"})
+
+	if _, err := reverse.register("web", stdtest.NewSession(t)); err == nil {
+		t.Fatal("expected error for an unconfigured tunnel")
+	}
+	if reverse.pick("ssh") != nil {
+		t.Fatal("expected no session before registration")
+	}
+
+	older, newer := stdtest.NewSession(t), stdtest.NewSession(t)
+	unregisterOlder, err := reverse.register("ssh", older)
+	if err != nil {
+		t.Fatalf("register returned error: %v", err)
+	}
+	unregisterNewer, err := reverse.register("ssh", newer)
+	if err != nil {
+		t.Fatalf("register returned error: %v", err)
+	}
+	if reverse.pick("ssh") != newer {
+		t.Fatal("expected the most recent registration to be picked")
+	}
+
+	newer.Close()
+	if reverse.pick("ssh") != older {
+		t.Fatal("expected closed sessions to be skipped")
+	}
+
+	unregisterNewer()
+	unregisterOlder()
+	if reverse.pick("ssh") != nil {
+		t.Fatal("expected no session after unregistering")
+	}
+}
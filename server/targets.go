@@ -0,0 +1,190 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// targetRule is one entry of the allowlist of destinations clients may
+// request. Rules are written as "host:port" where host is a literal host,
+// "*", a "*.domain" suffix or a CIDR, and port is a number, "min-max" or "*".
+// Entries that are not host:port pairs match unix socket paths verbatim.
+type targetRule struct {
+	path    string // unix socket path, exclusive with the fields below
+	host    string
+	suffix  string
+	ipnet   *net.IPNet
+	anyHost bool
+	minPort int
+	maxPort int
+}
+
+// targetAllowlist decides whether a requested destination may be dialed.
+type targetAllowlist []targetRule
+
+// parseTargetAllowlist compiles the allowlist entries from the config.
+func parseTargetAllowlist(entries []string) (targetAllowlist, error) {
+	list := make(targetAllowlist, 0, len(entries))
+	for _, entry := range entries {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			list = append(list, targetRule{path: entry})
+			continue
+		}
+
+		rule := targetRule{minPort: 1, maxPort: 65535}
+		switch {
+		case host == "*":
+			rule.anyHost = true
+		case strings.HasPrefix(host, "*."):
+			rule.suffix = strings.ToLower(host[1:])
+		case strings.Contains(host, "/"):
+			if _, rule.ipnet, err = net.ParseCIDR(host); err != nil {
+				return nil, errors.Wrapf(err, "allowtarget %q", entry)
+			}
+		default:
+			rule.host = strings.ToLower(host)
+		}
+
+		if port != "*" {
+			lo, hi, found := strings.Cut(port, "-")
+			if rule.minPort, err = strconv.Atoi(lo); err != nil {
+				return nil, errors.Wrapf(err, "allowtarget %q", entry)
+			}
+			rule.maxPort = rule.minPort
+			if found {
+				if rule.maxPort, err = strconv.Atoi(hi); err != nil {
+					return nil, errors.Wrapf(err, "allowtarget %q", entry)
+				}
+			}
+			if rule.minPort < 1 || rule.maxPort > 65535 || rule.minPort > rule.maxPort {
+				return nil, errors.Errorf("allowtarget %q: invalid port range", entry)
+			}
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// Allowed reports whether network/addr matches any rule of the allowlist.
+func (l targetAllowlist) Allowed(network, addr string) bool {
+	if network == "unix" {
+		for _, rule := range l {
+			if rule.path != "" && rule.path == addr {
+				return true
+			}
+		}
+		return false
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, rule := range l {
+		if rule.path != "" || port < rule.minPort || port > rule.maxPort {
+			continue
+		}
+		switch {
+		case rule.anyHost:
+			return true
+		case rule.suffix != "":
+			if ip == nil && strings.HasSuffix(host, rule.suffix) {
+				return true
+			}
+		case rule.ipnet != nil:
+			// CIDR rules only match literal addresses, hostnames are never
+			// resolved here to keep DNS out of the access decision.
+			if ip != nil && rule.ipnet.Contains(ip) {
+				return true
+			}
+		default:
+			if rule.host == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveTarget decides where a stream carrying hdr goes. Fields left empty
+// in the header fall back to the default target and its network; anything
+// other than the default target must be allowed explicitly.
+func resolveTarget(hdr *std.Header, network string, allow targetAllowlist, config *Config) (string, string, error) {
+	addr := config.Target
+	if hdr.Network != "" {
+		network = hdr.Network
+	}
+	if hdr.Addr != "" {
+		addr = hdr.Addr
+	}
+
+	if hdr.Group != "" {
+		if !config.Redundant {
+			return "", "", errors.Errorf("redundant streams not enabled: %v", addr)
+		}
+		if network == "udp" {
+			return "", "", errors.Errorf("redundant udp streams not supported: %v", addr)
+		}
+	}
+
+	if hdr.Resume != "" {
+		if config.Resume <= 0 {
+			return "", "", errors.Errorf("resumable streams not enabled: %v", addr)
+		}
+		if network == "udp" {
+			return "", "", errors.Errorf("resumable udp streams not supported: %v", addr)
+		}
+		if hdr.Group != "" {
+			return "", "", errors.Errorf("redundant streams cannot be resumable: %v", addr)
+		}
+	}
+
+	switch network {
+	case "tcp", "unix":
+	case "udp":
+		if !config.UDP {
+			return "", "", errors.Errorf("udp streams not enabled: %v", addr)
+		}
+	default:
+		return "", "", errors.Errorf("unsupported network: %v", network)
+	}
+
+	if addr != config.Target && !allow.Allowed(network, addr) {
+		return "", "", errors.Errorf("target not allowed: %v %v", network, addr)
+	}
+	return network, addr, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestTargetAllowlist(t *testing.T) {
+	list, err := parseTargetAllowlist([]string{
+		"127.0.0.1:22",
+		"db.internal:5432",
+		"*.example.com:443",
+		"10.0.0.0/8:8000-8100",
+		"*:53",
+		"/var/run/app.sock",
+	})
+	if err != nil {
+		t.Fatalf("parseTargetAllowlist returned error: %v", err)
+	}
+
+	tests := []struct {
+		network string
+		addr    string
+		want    bool
+	}{
+		{"tcp", "127.0.0.1:22", true},
+		{"tcp", "127.0.0.1:23", false},
+		{"tcp", "DB.internal:5432", true},
+		{"tcp", "www.example.com:443", true},
+		{"tcp", "example.com:443", false},
+		{"tcp", "10.1.2.3:8050", true},
+		{"tcp", "10.1.2.3:8200", false},
+		{"tcp", "11.1.2.3:8050", false},
+		{"tcp", "anything:53", true},
+		{"tcp", "noport", false},
+		{"unix", "/var/run/app.sock", true},
+		{"unix", "/var/run/other.sock", false},
+	}
+
+	for _, tt := range tests {
+		if got := list.Allowed(tt.network, tt.addr); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTargetAllowlistInvalid(t *testing.T) {
+	for _, entry := range []string{"host:0", "host:9-1", "host:abc", "300.0.0.0/8:*"} {
+		if _, err := parseTargetAllowlist([]string{entry}); err == nil {
+			t.Errorf("parseTargetAllowlist(%q) expected error", entry)
+		}
+	}
+}
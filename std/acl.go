@@ -0,0 +1,256 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// aclCheckInterval is how often the file of an ACL is checked for changes.
+	aclCheckInterval = 5 * time.Second
+
+	// aclRejectTTL is how long a client refused is remembered, it is not
+	// counted again in the meantime.
+	aclRejectTTL = 10 * time.Second
+
+	// aclMaxRejected caps the clients refused remembered at once.
+	aclMaxRejected = 4096
+)
+
+// ACLRejected counts the clients refused by an ACL, each once per aclRejectTTL.
+var ACLRejected = NewCounter("ACLRejected")
+
+// aclRules are CIDR allow and deny lists. Deny wins, and when there is an
+// allow list, addresses outside of it are denied too.
+type aclRules struct {
+	allow, deny []netip.Prefix
+}
+
+func (r *aclRules) allowed(ip netip.Addr) bool {
+	for _, p := range r.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, p := range r.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL admits the clients of a listener by their IP, from the lists of the
+// config joined with the ones of a file, which is read again once it changed:
+//
+//	# comment
+//	allow 10.0.0.0/8
+//	deny 10.1.2.3
+type ACL struct {
+	config aclRules                 // lists of the config
+	path   string                   // file of more lists, if any
+	rules  atomic.Pointer[aclRules] // lists of the config and the file
+	seen   *PeerMemory              // clients refused lately
+	log    *RateLog
+}
+
+// NewACL parses the CIDR ranges of allow and deny, a single IP standing for
+// itself, and loads the file at path when it is not empty. The result is nil,
+// admitting everyone, when there are no rules at all.
+func NewACL(allow, deny []string, path string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 && path == "" {
+		return nil, nil
+	}
+
+	a := &ACL{path: path, seen: NewPeerMemory(aclRejectTTL, aclMaxRejected), log: NewRateLog(time.Second)}
+	var err error
+	if a.config.allow, err = ParsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if a.config.deny, err = ParsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	file := new(aclRules)
+	if path != "" {
+		if file, err = readACLFile(path); err != nil {
+			return nil, err
+		}
+		go a.watch()
+	}
+	a.load(file)
+	return a, nil
+}
+
+// Admit reports whether the client at addr may connect. It is cheap enough
+// to be asked for every packet, see AdmitConn. A client refused is counted
+// once per aclRejectTTL, and logged at most once a second. Addresses which
+// are not IP, eg: of UNIX sockets, are always admitted.
+func (a *ACL) Admit(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	var ap netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ap = addr.AddrPort()
+	case *net.TCPAddr:
+		ap = addr.AddrPort()
+	default:
+		var err error
+		if ap, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return true
+		}
+	}
+	if !ap.Addr().IsValid() {
+		return true
+	}
+
+	if !a.rules.Load().allowed(ap.Addr().Unmap()) {
+		if a.seen.Remember(addr) {
+			ACLRejected.Inc()
+			a.log.Println("acl: rejected", addr)
+		}
+		return false
+	}
+	return true
+}
+
+// load joins the lists of file with the ones of the config.
+func (a *ACL) load(file *aclRules) {
+	a.rules.Store(&aclRules{
+		allow: append(append([]netip.Prefix(nil), a.config.allow...), file.allow...),
+		deny:  append(append([]netip.Prefix(nil), a.config.deny...), file.deny...),
+	})
+}
+
+// watch reads the file again whenever its modification time or size
+// changed. A file which fails to parse leaves the previous rules in place.
+func (a *ACL) watch() {
+	var last os.FileInfo
+	if fi, err := os.Stat(a.path); err == nil {
+		last = fi
+	}
+	ticker := time.NewTicker(aclCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fi, err := os.Stat(a.path)
+		if err != nil || last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		rules, err := readACLFile(a.path)
+		if err != nil {
+			log.Println("acl:", err)
+			continue
+		}
+		a.load(rules)
+		log.Println("acl: reloaded", a.path, "allow:", len(rules.allow), "deny:", len(rules.deny))
+	}
+}
+
+// readACLFile parses the allow and deny lines of the file at path.
+func readACLFile(path string) (*aclRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	rules := new(aclRules)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%v:%d: expected allow or deny followed by a CIDR range", path, n)
+		}
+		p, err := ParsePrefix(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%v:%d", path, n)
+		}
+		switch fields[0] {
+		case "allow":
+			rules.allow = append(rules.allow, p)
+		case "deny":
+			rules.deny = append(rules.deny, p)
+		default:
+			return nil, errors.Errorf("%v:%d: unknown rule %q", path, n, fields[0])
+		}
+	}
+	return rules, errors.WithStack(scanner.Err())
+}
+
+// ParsePrefixes parses a list of CIDR ranges or single IPs, see ParsePrefix.
+func ParsePrefixes(ss []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range ss {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// ParsePrefix parses a CIDR range, or a single IP. IPv4-mapped ones, eg:
+// ::ffff:10.0.0.0/104, become IPv4, as the addresses they are matched with.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, errors.Errorf("bad IP or CIDR range: %q", s)
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Errorf("bad IP or CIDR range: %q", s)
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, errors.Errorf("IPv4-mapped CIDR range shorter than /96: %q", s)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
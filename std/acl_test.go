@@ -0,0 +1,136 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestACLConfigLists(t *testing.T) {
+	acl, err := NewACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.2.3"}, "")
+	if err != nil {
+		t.Fatalf("NewACL returned error: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false, // deny wins
+		"192.168.0.1": false, // outside of the allow list
+		"2001:db8::1": true,
+	} {
+		if got := acl.Admit(tcpAddr(ip)); got != want {
+			t.Errorf("Admit(%v) = %v, want %v", ip, got, want)
+		}
+	}
+	if !acl.Admit(tcpAddr("::ffff:10.0.0.1")) {
+		t.Error("expected an IPv4-mapped address to match its IPv4 range")
+	}
+	if !acl.Admit(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}) {
+		t.Error("expected non-IP addresses to be admitted")
+	}
+
+	if _, err := NewACL([]string{"10.0.0.0/33"}, nil, ""); err == nil {
+		t.Error("expected error for a bad CIDR range")
+	}
+
+	// IPv4-mapped ranges match the IPv4 addresses they map.
+	acl, err = NewACL(nil, []string{"::ffff:10.0.0.0/104"}, "")
+	if err != nil {
+		t.Fatalf("NewACL returned error: %v", err)
+	}
+	if acl.Admit(tcpAddr("10.1.2.3")) || !acl.Admit(tcpAddr("11.1.2.3")) {
+		t.Error("expected an IPv4-mapped range to match its IPv4 addresses")
+	}
+
+	// A client refused is counted once, however often it comes back.
+	rejected := ACLRejected.Load()
+	for i := 0; i < 10; i++ {
+		acl.Admit(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	}
+	if n := ACLRejected.Load() - rejected; n != 1 {
+		t.Errorf("expected 1 rejection counted, got %d", n)
+	}
+
+	acl, err = NewACL(nil, nil, "")
+	if err != nil || acl != nil {
+		t.Fatalf("expected a nil ACL without rules, got %v, %v", acl, err)
+	}
+	if !acl.Admit(tcpAddr("1.2.3.4")) {
+		t.Error("expected a nil ACL to admit everyone")
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte("# office\nallow 192.168.1.0/24\ndeny 192.168.1.66 # printer\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := NewACL([]string{"10.0.0.0/8"}, nil, path)
+	if err != nil {
+		t.Fatalf("NewACL returned error: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":     true, // allowed by the config
+		"192.168.1.10": true, // allowed by the file
+		"192.168.1.66": false,
+		"172.16.0.1":   false,
+	} {
+		if got := acl.Admit(tcpAddr(ip)); got != want {
+			t.Errorf("Admit(%v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// A reload replaces the lists of the file only.
+	if err := os.WriteFile(path, []byte("deny 10.9.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readACLFile(path)
+	if err != nil {
+		t.Fatalf("readACLFile returned error: %v", err)
+	}
+	acl.load(rules)
+	for ip, want := range map[string]bool{
+		"10.0.0.1":     true,
+		"10.9.0.1":     false,
+		"192.168.1.10": false,
+	} {
+		if got := acl.Admit(tcpAddr(ip)); got != want {
+			t.Errorf("after reload, Admit(%v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	for _, bad := range []string{"permit 10.0.0.0/8\n", "allow\n", "deny 10.0.0.300\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readACLFile(path); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AdmitConn drops the packets of the peers admit turns down, so a server
+// listening on it never sets up a session for them. kcp-go opens a session
+// for any new address, rejecting it once accepted would only see it come
+// back with the next packet.
+type AdmitConn struct {
+	net.PacketConn
+	admit func(addr net.Addr) bool
+}
+
+// NewAdmitConn wraps conn, admit is asked for every packet read.
+func NewAdmitConn(conn net.PacketConn, admit func(addr net.Addr) bool) *AdmitConn {
+	return &AdmitConn{PacketConn: conn, admit: admit}
+}
+
+func (c *AdmitConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.admit(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// PeerMemory remembers peers for a while, eg: to count a client turned
+// down once, however many packets it sends. As any packet may add a peer,
+// it holds up to max of them, the ones beyond are not remembered.
+type PeerMemory struct {
+	ttl time.Duration
+	max int
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewPeerMemory remembers each peer for ttl.
+func NewPeerMemory(ttl time.Duration, max int) *PeerMemory {
+	return &PeerMemory{ttl: ttl, max: max, seen: make(map[string]time.Time)}
+}
+
+// Remember records addr, and reports whether it was new, that is not seen
+// within ttl.
+func (m *PeerMemory) Remember(addr net.Addr) bool {
+	key, now := addr.String(), time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if seen, ok := m.seen[key]; ok && now.Sub(seen) < m.ttl {
+		return false
+	}
+	if len(m.seen) >= m.max {
+		for k, seen := range m.seen {
+			if now.Sub(seen) >= m.ttl {
+				delete(m.seen, k)
+			}
+		}
+	}
+	if len(m.seen) < m.max {
+		m.seen[key] = now
+	}
+	return true
+}
+
+func (c *AdmitConn) SetReadBuffer(bytes int) error  { return setReadBuffer(c.PacketConn, bytes) }
+func (c *AdmitConn) SetWriteBuffer(bytes int) error { return setWriteBuffer(c.PacketConn, bytes) }
+func (c *AdmitConn) SetDSCP(dscp int) error         { return setDSCP(c.PacketConn, dscp) }
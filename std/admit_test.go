@@ -0,0 +1,69 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmitConn(t *testing.T) {
+	denied, allowed := listenLoopback(t), listenLoopback(t)
+	server := NewAdmitConn(listenLoopback(t), func(addr net.Addr) bool {
+		return addr.String() != denied.LocalAddr().String()
+	})
+
+	denied.WriteTo([]byte("denied"), server.LocalAddr())
+	allowed.WriteTo([]byte("allowed"), server.LocalAddr())
+
+	buf := make([]byte, maxPacketSize)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "allowed" || addr.String() != allowed.LocalAddr().String() {
+		t.Fatalf("got %q from %v, %v", buf[:n], addr, err)
+	}
+
+	// Read errors are passed on.
+	server.SetReadDeadline(time.Now())
+	if _, _, err := server.ReadFrom(buf); err == nil {
+		t.Fatal("ReadFrom returned no error past the deadline")
+	}
+}
+
+func TestPeerMemory(t *testing.T) {
+	m := NewPeerMemory(time.Hour, 2)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	c := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1000}
+	if !m.Remember(a) || !m.Remember(b) {
+		t.Fatal("expected new peers to be reported")
+	}
+	if m.Remember(a) {
+		t.Fatal("expected a peer remembered to be reported once")
+	}
+
+	// Beyond max, peers are reported every time.
+	if !m.Remember(c) || !m.Remember(c) {
+		t.Fatal("expected a peer over max to be reported every time")
+	}
+}
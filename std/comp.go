@@ -56,6 +56,15 @@ func (c *CompStream) Close() error {
 	return c.conn.Close()
 }
 
+// CloseWrite half-closes the underlying connection when it supports it.
+// Every Write is flushed, so nothing is left buffered at this point.
+func (c *CompStream) CloseWrite() error {
+	if cw, ok := c.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.conn.Close()
+}
+
 func (c *CompStream) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
@@ -30,37 +30,41 @@ import (
 // BaseConfig contains shared configuration fields between client and server.
 // Embedding this struct reduces code duplication and ensures consistency.
 type BaseConfig struct {
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	MTU          int    `json:"mtu"`
-	RateLimit    int    `json:"ratelimit"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	SmuxVer      int    `json:"smuxver"`
-	SmuxBuf      int    `json:"smuxbuf"`
-	FrameSize    int    `json:"framesize"`
-	StreamBuf    int    `json:"streambuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Quiet        bool   `json:"quiet"`
-	TCP          bool   `json:"tcp"`
-	Pprof        bool   `json:"pprof"`
-	QPP          bool   `json:"qpp"`
-	QPPCount     int    `json:"qpp-count"`
-	CloseWait    int    `json:"closewait"`
+	Key          string   `json:"key"`
+	Crypt        string   `json:"crypt"`
+	Mode         string   `json:"mode"`
+	MTU          int      `json:"mtu"`
+	RateLimit    int      `json:"ratelimit"`
+	SndWnd       int      `json:"sndwnd"`
+	RcvWnd       int      `json:"rcvwnd"`
+	DataShard    int      `json:"datashard"`
+	ParityShard  int      `json:"parityshard"`
+	DSCP         int      `json:"dscp"`
+	NoComp       bool     `json:"nocomp"`
+	AckNodelay   bool     `json:"acknodelay"`
+	NoDelay      int      `json:"nodelay"`
+	Interval     int      `json:"interval"`
+	Resend       int      `json:"resend"`
+	NoCongestion int      `json:"nc"`
+	SockBuf      int      `json:"sockbuf"`
+	SmuxVer      int      `json:"smuxver"`
+	SmuxBuf      int      `json:"smuxbuf"`
+	FrameSize    int      `json:"framesize"`
+	StreamBuf    int      `json:"streambuf"`
+	KeepAlive    int      `json:"keepalive"`
+	Log          string   `json:"log"`
+	SnmpLog      string   `json:"snmplog"`
+	SnmpPeriod   int      `json:"snmpperiod"`
+	Quiet        bool     `json:"quiet"`
+	TCP          bool     `json:"tcp"`
+	Pprof        bool     `json:"pprof"`
+	QPP          bool     `json:"qpp"`
+	QPPCount     int      `json:"qpp-count"`
+	CloseWait    int      `json:"closewait"`
+	Drain        int      `json:"drain"`
+	AllowIP      []string `json:"allowip"` // CIDR ranges of the clients admitted, see ACL
+	DenyIP       []string `json:"denyip"`  // CIDR ranges of the clients refused
+	ACLFile      string   `json:"aclfile"` // file of more allow and deny rules, read again once it changed
 }
 
 // ModeParams contains the KCP parameters for different transmission modes.
@@ -70,6 +70,9 @@ type closeWriter interface {
 // when one direction finishes, it signals the peer that no more data will be sent,
 // while still allowing data to be received from the other direction.
 func Pipe(alice, bob io.ReadWriteCloser, closeWait int) (errA, errB error) {
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDatagramSize is the largest UDP payload that can be framed on a stream.
+const MaxDatagramSize = 65535
+
+// UDP datagrams travel over smux streams with a 2-byte big-endian length
+// prefix, so message boundaries survive the byte stream.
+
+// WriteDatagram frames p and writes it with a single Write call.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return errors.Errorf("datagram too large: %d bytes", len(p))
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	_, err := w.Write(buf)
+	return errors.WithStack(err)
+}
+
+// ReadDatagram reads one framed datagram into buf, which must be able to hold
+// MaxDatagramSize bytes, and returns its length.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return 0, errors.Errorf("datagram too large: %d bytes", n)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PipeDatagrams relays framed datagrams between stream and a connected UDP
+// socket until the stream ends, then closes both sides.
+func PipeDatagrams(stream io.ReadWriteCloser, conn net.Conn) (errA, errB error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// stream -> conn
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, err := ReadDatagram(stream, buf)
+			if err != nil {
+				errA = err
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				errA = err
+				return
+			}
+		}
+	}()
+
+	// conn -> stream
+	go func() {
+		defer wg.Done()
+		defer stream.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// an ICMP port unreachable from the target is not fatal
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					continue
+				}
+				if !errors.Is(err, net.ErrClosed) {
+					errB = err
+				}
+				return
+			}
+			if err := WriteDatagram(stream, buf[:n]); err != nil {
+				errB = err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	return
+}
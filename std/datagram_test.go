@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msgs := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), 1500)}
+	for _, m := range msgs {
+		if err := WriteDatagram(&buf, m); err != nil {
+			t.Fatalf("WriteDatagram returned error: %v", err)
+		}
+	}
+
+	out := make([]byte, MaxDatagramSize)
+	for _, want := range msgs {
+		n, err := ReadDatagram(&buf, out)
+		if err != nil {
+			t.Fatalf("ReadDatagram returned error: %v", err)
+		}
+		if !bytes.Equal(out[:n], want) {
+			t.Fatalf("datagram mismatch: got %d bytes, want %d", n, len(want))
+		}
+	}
+
+	if err := WriteDatagram(&buf, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Fatalf("WriteDatagram expected error for oversized datagram")
+	}
+}
+
+func TestPipeDatagrams(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+
+	// echo every datagram back with a prefix
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(append([]byte("re:"), buf[:n]...), addr)
+		}
+	}()
+
+	conn, err := net.Dial("udp", target.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		PipeDatagrams(remote, conn)
+		close(done)
+	}()
+
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := WriteDatagram(local, []byte("ping")); err != nil {
+		t.Fatalf("WriteDatagram: %v", err)
+	}
+	out := make([]byte, MaxDatagramSize)
+	n, err := ReadDatagram(local, out)
+	if err != nil || string(out[:n]) != "re:ping" {
+		t.Fatalf("unexpected reply %q: %v", out[:n], err)
+	}
+
+	local.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("PipeDatagrams did not return after the stream closed")
+	}
+}
@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EXIT_WAIT = 5 // default max seconds to drain the streams before exit
+)
+
+// activeStreams counts the streams being piped, see Pipe.
+var activeStreams atomic.Int64
+
+// ActiveStreams returns the number of streams being piped.
+func ActiveStreams() int64 { return activeStreams.Load() }
+
+// shutdown holds what a drain needs to stop the process gracefully.
+var shutdown struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	stops    []func()
+	sessions map[io.Closer]struct{}
+	draining bool
+}
+
+// SetDrainTimeout sets how long Drain waits for the active streams.
+func SetDrainTimeout(timeout time.Duration) {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	shutdown.timeout = timeout
+}
+
+// OnShutdown registers stop to be called when Drain begins, to stop
+// accepting new clients or sessions.
+func OnShutdown(stop func()) {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	shutdown.stops = append(shutdown.stops, stop)
+}
+
+// TrackSession adds session to those Drain closes once the streams are
+// done, until the returned function is called.
+func TrackSession(session io.Closer) (untrack func()) {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	if shutdown.sessions == nil {
+		shutdown.sessions = make(map[io.Closer]struct{})
+	}
+	shutdown.sessions[session] = struct{}{}
+	return func() {
+		shutdown.mu.Lock()
+		defer shutdown.mu.Unlock()
+		delete(shutdown.sessions, session)
+	}
+}
+
+// Draining reports whether Drain began, accept loops use it to tell a
+// listener closed on purpose from a failing one.
+func Draining() bool {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	return shutdown.draining
+}
+
+// Drain stops accepting, waits for the active streams to finish for up to
+// the drain timeout while logging their number, then closes the tracked
+// sessions.
+func Drain() {
+	shutdown.mu.Lock()
+	shutdown.draining = true
+	stops, timeout := shutdown.stops, shutdown.timeout
+	shutdown.mu.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var logged time.Time
+	for n := ActiveStreams(); n > 0 && time.Now().Before(deadline); n = ActiveStreams() {
+		if time.Since(logged) >= time.Second {
+			log.Println("draining:", n, "streams active, exiting in", time.Until(deadline).Round(time.Second))
+			logged = time.Now()
+		}
+		<-ticker.C
+	}
+	if n := ActiveStreams(); n > 0 {
+		log.Println("drain timeout:", n, "streams cut off")
+	}
+
+	shutdown.mu.Lock()
+	sessions := make([]io.Closer, 0, len(shutdown.sessions))
+	for session := range shutdown.sessions {
+		sessions = append(sessions, session)
+	}
+	shutdown.mu.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+	log.Println("drained, closed", len(sessions), "sessions")
+}
@@ -0,0 +1,76 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closerStub struct{ closed atomic.Bool }
+
+func (c *closerStub) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	SetDrainTimeout(5 * time.Second)
+	defer SetDrainTimeout(0)
+
+	var stopped atomic.Bool
+	OnShutdown(func() { stopped.Store(true) })
+	tracked, untracked := new(closerStub), new(closerStub)
+	TrackSession(tracked)
+	TrackSession(untracked)()
+
+	// A stream which finishes a moment after the drain began.
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	go Pipe(a2, b1, 0)
+	time.Sleep(10 * time.Millisecond)
+	if ActiveStreams() != 1 {
+		t.Fatalf("got %d active streams, want 1", ActiveStreams())
+	}
+	time.AfterFunc(200*time.Millisecond, func() {
+		a1.Close()
+		b2.Close()
+	})
+
+	start := time.Now()
+	Drain()
+	if !Draining() || !stopped.Load() {
+		t.Fatal("shutdown hooks not run")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("drain took %v, want it to end with the stream", elapsed)
+	}
+	if ActiveStreams() != 0 {
+		t.Fatalf("got %d active streams after drain", ActiveStreams())
+	}
+	if !tracked.closed.Load() || untracked.closed.Load() {
+		t.Fatal("drain must close the tracked sessions only")
+	}
+}
@@ -0,0 +1,325 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// A redundant stream is carried by several legs, each a stream of its own,
+// usually over sessions taking different paths. Every chunk written is
+// framed with a sequence number and sent on all legs, and the reader
+// delivers every sequence number once, from the leg it arrives on first:
+//
+//	+-----+-----+---------+
+//	| SEQ | LEN | PAYLOAD |
+//	| 8B  | 2B  |   LEN   |
+//	+-----+-----+---------+
+//
+// A frame with LEN 0 ends the stream in its direction. As long as one leg
+// survives the stream goes on, at the pace of its fastest leg: every leg has
+// a writer of its own, and a leg falling too far behind is dropped.
+
+// dupMaxPayload bounds the payload of a single frame.
+const dupMaxPayload = 16 * 1024
+
+// dupQueueLen is the number of frames a leg may lag behind the others. A leg
+// lagging further, eg: over a stalled path, is dropped while another leg
+// keeps up; when every leg lags, writes wait for the fastest one.
+const dupQueueLen = 64
+
+// Redundant stream statistics, written to the SNMP log.
+var (
+	dupFramesSent    = NewCounter("RedundantFramesSent") // frames written, counted once per leg
+	dupFramesDropped = NewCounter("RedundantDuplicates") // frames received after another leg delivered them
+	dupLegsLost      = NewCounter("RedundantLegsLost")   // legs failing or falling behind before their stream ended
+)
+
+// dupLeg is a leg of a redundant stream with the frames queued for it.
+type dupLeg struct {
+	io.ReadWriteCloser
+	queue   chan []byte
+	written atomic.Uint64 // frames written so far, in order
+	dead    atomic.Bool
+	once    sync.Once
+}
+
+// drop gives up on the leg, the frames still queued for it are discarded.
+func (l *dupLeg) drop() {
+	l.once.Do(func() {
+		l.dead.Store(true)
+		l.Close()
+	})
+}
+
+// DupConn joins the legs of a redundant stream into a single stream.
+type DupConn struct {
+	legs  []*dupLeg
+	space chan struct{} // a leg wrote a frame
+	done  chan struct{} // closed by Close
+	once  sync.Once
+
+	wmu  sync.Mutex
+	wseq uint64
+
+	rmu      sync.Mutex
+	rseq     uint64
+	eof      bool // the peer ended the stream
+	closed   bool // the stream was closed locally
+	legsLeft int
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+}
+
+// NewDupConn starts reading and writing the legs of a redundant stream.
+func NewDupConn(legs []io.ReadWriteCloser) *DupConn {
+	pr, pw := io.Pipe()
+	c := &DupConn{
+		space:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		legsLeft: len(legs),
+		pr:       pr,
+		pw:       pw,
+	}
+	for _, rwc := range legs {
+		leg := &dupLeg{ReadWriteCloser: rwc, queue: make(chan []byte, dupQueueLen)}
+		c.legs = append(c.legs, leg)
+		go c.readLeg(leg)
+		go c.writeLeg(leg)
+	}
+	return c
+}
+
+// readLeg delivers the frames of leg that no other leg delivered yet.
+func (c *DupConn) readLeg(leg *dupLeg) {
+	var hdr [10]byte
+	buf := make([]byte, dupMaxPayload)
+	for {
+		if _, err := io.ReadFull(leg, hdr[:]); err != nil {
+			c.legDone(leg, err)
+			return
+		}
+		seq := binary.BigEndian.Uint64(hdr[:8])
+		n := int(binary.BigEndian.Uint16(hdr[8:]))
+		if n > dupMaxPayload {
+			c.legDone(leg, errors.Errorf("redundant frame too long: %d bytes", n))
+			return
+		}
+		if _, err := io.ReadFull(leg, buf[:n]); err != nil {
+			c.legDone(leg, err)
+			return
+		}
+
+		c.rmu.Lock()
+		switch {
+		case seq < c.rseq:
+			dupFramesDropped.Inc()
+		case seq > c.rseq:
+			// Legs carry every frame in order, a gap means a broken peer.
+			c.rmu.Unlock()
+			c.legDone(leg, errors.Errorf("redundant frame %d ahead of %d", seq, c.rseq))
+			return
+		case n == 0:
+			c.rseq++
+			c.eof = true
+			c.pw.Close()
+		default:
+			c.rseq++
+			// Blocks until read, which holds back the other legs as well.
+			c.pw.Write(buf[:n])
+		}
+		c.rmu.Unlock()
+	}
+}
+
+// legDone retires a leg that stopped delivering frames, failing the stream
+// once no leg is left before its end.
+func (c *DupConn) legDone(leg *dupLeg, err error) {
+	leg.drop()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.legsLeft--
+	if c.eof || c.closed {
+		return
+	}
+	dupLegsLost.Inc()
+	if c.legsLeft == 0 {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.pw.CloseWithError(err)
+	}
+}
+
+// writeLeg writes the frames queued for leg, each leg at its own pace.
+func (c *DupConn) writeLeg(leg *dupLeg) {
+	for {
+		select {
+		case frame := <-leg.queue:
+			if !leg.dead.Load() {
+				if _, err := leg.Write(frame); err != nil {
+					leg.drop()
+				} else {
+					leg.written.Add(1)
+					dupFramesSent.Inc()
+				}
+			}
+			select {
+			case c.space <- struct{}{}:
+			default:
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// wait blocks until a leg wrote a frame.
+func (c *DupConn) wait() error {
+	select {
+	case <-c.space:
+		return nil
+	case <-c.done:
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+}
+
+// Read returns the payload of the stream in order, without duplicates.
+func (c *DupConn) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// Write queues p on every leg which is still alive, and returns once the
+// fastest leg wrote it.
+func (c *DupConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(p) > 0 {
+		chunk := p[:min(len(p), dupMaxPayload)]
+		if err := c.writeFrame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, c.flushed(c.wseq - 1)
+}
+
+// writeFrame queues one frame on every live leg, dropping the legs which
+// fell behind. It is called with wmu held.
+func (c *DupConn) writeFrame(payload []byte) error {
+	frame := make([]byte, 10+len(payload))
+	binary.BigEndian.PutUint64(frame, c.wseq)
+	binary.BigEndian.PutUint16(frame[8:], uint16(len(payload)))
+	copy(frame[10:], payload)
+
+	// Wait for the fastest leg when every leg is behind.
+	for {
+		live, room := false, false
+		for _, leg := range c.legs {
+			if !leg.dead.Load() {
+				live = true
+				room = room || len(leg.queue) < cap(leg.queue)
+			}
+		}
+		if !live {
+			return errors.WithStack(io.ErrClosedPipe)
+		}
+		if room {
+			break
+		}
+		if err := c.wait(); err != nil {
+			return err
+		}
+	}
+
+	for _, leg := range c.legs {
+		if leg.dead.Load() {
+			continue
+		}
+		// Every leg gets its own copy, writers like QPPPort work in place.
+		select {
+		case leg.queue <- append([]byte(nil), frame...):
+		default:
+			leg.drop() // another leg keeps up
+		}
+	}
+	c.wseq++
+	return nil
+}
+
+// CloseWrite tells the peer that no more data follows, the legs stay open
+// for the other direction.
+func (c *DupConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.writeFrame(nil); err != nil {
+		return err
+	}
+	return c.flushed(c.wseq - 1)
+}
+
+// flushed waits until a leg wrote every frame up to seq. It is called with
+// wmu held.
+func (c *DupConn) flushed(seq uint64) error {
+	for {
+		live := false
+		for _, leg := range c.legs {
+			if leg.dead.Load() {
+				continue
+			}
+			if leg.written.Load() > seq {
+				return nil
+			}
+			live = true
+		}
+		if !live {
+			return errors.WithStack(io.ErrClosedPipe)
+		}
+		if err := c.wait(); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes every leg.
+func (c *DupConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	// Closing the pipe first unblocks a leg delivering a frame.
+	c.pr.Close()
+	c.rmu.Lock()
+	c.closed = true
+	c.rmu.Unlock()
+	for _, leg := range c.legs {
+		leg.Close()
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/qpp"
+)
+
+// newDupPair returns the two ends of a redundant stream over n legs.
+func newDupPair(n int) (*DupConn, *DupConn, []net.Conn) {
+	var a, b []io.ReadWriteCloser
+	var legs []net.Conn
+	for i := 0; i < n; i++ {
+		c1, c2 := net.Pipe()
+		a, b = append(a, c1), append(b, c2)
+		legs = append(legs, c1)
+	}
+	return NewDupConn(a), NewDupConn(b), legs
+}
+
+func TestDupConnDeliversOnce(t *testing.T) {
+	alice, bob, _ := newDupPair(2)
+	defer alice.Close()
+	defer bob.Close()
+
+	payload := bytes.Repeat([]byte("redundant"), 5000) // several frames
+	dropped := dupFramesDropped.Load()
+	go func() {
+		alice.Write(payload)
+		alice.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(bob)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want the %d bytes written", len(got), len(payload))
+	}
+
+	// Every frame but the ones still in flight on the slower leg is dropped
+	// once; the EOF frame arrives on both legs too.
+	if dupFramesDropped.Load() == dropped {
+		t.Fatal("no duplicate counted")
+	}
+}
+
+func TestDupConnSurvivesLostLeg(t *testing.T) {
+	alice, bob, legs := newDupPair(2)
+	defer alice.Close()
+	defer bob.Close()
+
+	go func() {
+		alice.Write([]byte("before"))
+		legs[0].Close()
+		alice.Write([]byte(" after"))
+		alice.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(bob)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != "before after" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// stalledLeg is a leg over a path that stopped, until it is closed.
+type stalledLeg struct{ closed chan struct{} }
+
+func (l *stalledLeg) Read(p []byte) (int, error)  { <-l.closed; return 0, io.EOF }
+func (l *stalledLeg) Write(p []byte) (int, error) { <-l.closed; return 0, io.ErrClosedPipe }
+func (l *stalledLeg) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func TestDupConnDropsStalledLeg(t *testing.T) {
+	c1, c2 := net.Pipe()
+	stalled := &stalledLeg{closed: make(chan struct{})}
+	alice, bob := NewDupConn([]io.ReadWriteCloser{c1, stalled}), NewDupConn([]io.ReadWriteCloser{c2})
+	defer alice.Close()
+	defer bob.Close()
+
+	lost := dupLegsLost.Load()
+	payload := bytes.Repeat([]byte("x"), (dupQueueLen+8)*dupMaxPayload)
+	go func() {
+		alice.Write(payload)
+		alice.CloseWrite()
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		got, _ := io.ReadAll(bob)
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		if len(got) != len(payload) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled leg held back the stream")
+	}
+
+	select {
+	case <-stalled.closed:
+	default:
+		t.Fatal("expected the stalled leg to be dropped")
+	}
+	if dupLegsLost.Load() == lost {
+		t.Fatal("dropped leg not counted")
+	}
+}
+
+func TestDupConnAllLegsLost(t *testing.T) {
+	alice, bob, legs := newDupPair(2)
+	defer bob.Close()
+
+	go func() {
+		alice.Write([]byte("partial"))
+		for _, leg := range legs {
+			leg.Close()
+		}
+	}()
+
+	got, err := io.ReadAll(bob)
+	if err == nil {
+		t.Fatal("expected an error when every leg is lost before the end")
+	}
+	if string(got) != "partial" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := alice.Write([]byte("x")); err == nil {
+		t.Fatal("expected write error without legs")
+	}
+}
+
+func TestDupConnQPPLegs(t *testing.T) {
+	// QPPPort encrypts in place, every leg must see the plain frame. Only
+	// the second leg is read to tell.
+	pad := qpp.NewQPP([]byte("pad-seed"), 16)
+	seed := []byte("stream-seed")
+	var a, b []io.ReadWriteCloser
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		a = append(a, NewQPPPort(c1, pad, seed))
+		b = append(b, NewQPPPort(c2, pad, seed))
+	}
+	go io.Copy(io.Discard, b[0])
+	alice, bob := NewDupConn(a), NewDupConn(b[1:])
+	defer alice.Close()
+	defer bob.Close()
+
+	go func() {
+		alice.Write([]byte("permuted"))
+		alice.CloseWrite()
+	}()
+	got, err := io.ReadAll(bob)
+	if err != nil || string(got) != "permuted" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
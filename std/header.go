@@ -0,0 +1,328 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A stream header is optionally written by the opening side right after
+// OpenStream() to name the destination of that stream:
+//
+//	+-------+--------+------------------------------+
+//	| MAGIC | LENGTH | ATTRIBUTES (TYPE|LEN|VALUE)* |
+//	|  4B   |   2B   |            LENGTH            |
+//	+-------+--------+------------------------------+
+//
+// The accepting side answers with a single status byte before any payload.
+// Streams which do not start with MAGIC carry no header at all, which keeps
+// older peers working unchanged.
+var headerMagic = [4]byte{0xfb, 'k', 'c', 'p'}
+
+const (
+	// maxHeaderSize bounds the attribute block of a header.
+	maxHeaderSize = 1024
+
+	attrNetwork = 0x01 // "tcp", "unix", "udp" or NetworkReverse
+	attrAddr    = 0x02 // host:port, a path for unix sockets, or a reverse tunnel name
+	attrComp    = 0x03 // present when the payload is snappy compressed
+	attrSrc     = 0x04 // ip:port of the client that opened the connection
+	attrDst     = 0x05 // ip:port that client connected to
+	attrGroup   = 0x06 // id of a redundant stream followed by its number of legs, see DupConn
+	attrResume  = 0x07 // id of a resumable stream followed by 1 when reattaching, see ResumeConn
+)
+
+// Reply codes written back by the accepting side of a header.
+const (
+	ReplyOK          byte = 0x00
+	ReplyFailure     byte = 0x01
+	ReplyNotAllowed  byte = 0x02
+	ReplyUnreachable byte = 0x03
+	ReplyRefused     byte = 0x04
+	ReplyTimeout     byte = 0x05
+)
+
+// ErrNotAllowed is reported when the peer refuses the requested destination.
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// Header describes the destination requested for a single stream.
+type Header struct {
+	Network  string
+	Addr     string
+	Comp     bool   // compress the payload of this stream, see CompStream
+	Src      string // original client address, passed on with PROXY protocol
+	Dst      string // address the original client connected to
+	Group    string // id shared by the legs of a redundant stream
+	Legs     int    // number of legs opened for Group
+	Resume   string // id of a resumable stream
+	Reattach bool   // attach a new leg to the existing stream Resume
+}
+
+// Marshal encodes the header into its wire format.
+func (h *Header) Marshal() ([]byte, error) {
+	var comp string
+	if h.Comp {
+		comp = "\x01"
+	}
+	var group string
+	if h.Group != "" {
+		group = h.Group + string([]byte{byte(h.Legs)})
+	}
+	var resume string
+	if h.Resume != "" {
+		resume = h.Resume + "\x00"
+		if h.Reattach {
+			resume = h.Resume + "\x01"
+		}
+	}
+
+	var attrs bytes.Buffer
+	for _, attr := range []struct {
+		typ   byte
+		value string
+	}{
+		{attrNetwork, h.Network},
+		{attrAddr, h.Addr},
+		{attrComp, comp},
+		{attrSrc, h.Src},
+		{attrDst, h.Dst},
+		{attrGroup, group},
+		{attrResume, resume},
+	} {
+		if attr.value == "" {
+			continue
+		}
+		if len(attr.value) > 255 {
+			return nil, errors.Errorf("header attribute %d too long: %d bytes", attr.typ, len(attr.value))
+		}
+		attrs.WriteByte(attr.typ)
+		attrs.WriteByte(byte(len(attr.value)))
+		attrs.WriteString(attr.value)
+	}
+
+	if attrs.Len() > maxHeaderSize {
+		return nil, errors.Errorf("header too long: %d bytes", attrs.Len())
+	}
+
+	buf := make([]byte, 0, len(headerMagic)+2+attrs.Len())
+	buf = append(buf, headerMagic[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(attrs.Len()))
+	return append(buf, attrs.Bytes()...), nil
+}
+
+// unmarshalAttrs decodes the attribute block following MAGIC and LENGTH.
+func (h *Header) unmarshalAttrs(attrs []byte) error {
+	for len(attrs) > 0 {
+		if len(attrs) < 2 || len(attrs) < 2+int(attrs[1]) {
+			return errors.New("truncated header attribute")
+		}
+		typ, value := attrs[0], string(attrs[2:2+int(attrs[1])])
+		attrs = attrs[2+int(attrs[1]):]
+
+		switch typ {
+		case attrNetwork:
+			h.Network = value
+		case attrAddr:
+			h.Addr = value
+		case attrComp:
+			h.Comp = value != "" && value[0] != 0
+		case attrSrc:
+			h.Src = value
+		case attrDst:
+			h.Dst = value
+		case attrGroup:
+			if len(value) > 1 {
+				h.Group, h.Legs = value[:len(value)-1], int(value[len(value)-1])
+			}
+		case attrResume:
+			if len(value) > 1 {
+				h.Resume, h.Reattach = value[:len(value)-1], value[len(value)-1] != 0
+			}
+		}
+		// unknown attributes are skipped so newer peers can extend the header
+	}
+	return nil
+}
+
+// WriteHeader sends hdr on w.
+func WriteHeader(w io.Writer, hdr *Header) error {
+	buf, err := hdr.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return errors.WithStack(err)
+}
+
+// ReadHeader reads a header that is known to be present on r.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var fixed [len(headerMagic) + 2]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !bytes.Equal(fixed[:len(headerMagic)], headerMagic[:]) {
+		return nil, errors.New("bad header magic")
+	}
+	return readHeaderBody(r, fixed[len(headerMagic):])
+}
+
+// readHeaderBody reads the attribute block whose size is encoded in length.
+func readHeaderBody(r io.Reader, length []byte) (*Header, error) {
+	n := binary.BigEndian.Uint16(length)
+	if n > maxHeaderSize {
+		return nil, errors.Errorf("header too long: %d bytes", n)
+	}
+
+	attrs := make([]byte, n)
+	if _, err := io.ReadFull(r, attrs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	hdr := new(Header)
+	if err := hdr.unmarshalAttrs(attrs); err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// ProbeHeader checks whether conn starts with a header and decodes it. When
+// the stream carries no header, hdr is nil and prefix holds the bytes that
+// were consumed while probing; the caller must replay them, see PrefixConn.
+//
+// A peer that stays silent for timeout is treated as headerless, so
+// server-first protocols keep working with older clients.
+func ProbeHeader(conn net.Conn, timeout time.Duration) (hdr *Header, prefix []byte, err error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var fixed [len(headerMagic) + 2]byte
+	n := 0
+	for n < len(headerMagic) {
+		nr, err := conn.Read(fixed[n:len(headerMagic)])
+		n += nr
+		if !bytes.Equal(fixed[:n], headerMagic[:n]) {
+			break
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	if n < len(headerMagic) || !bytes.Equal(fixed[:n], headerMagic[:]) {
+		return nil, fixed[:n], errors.WithStack(conn.SetReadDeadline(time.Time{}))
+	}
+
+	// The magic matched, the rest of the header must follow.
+	if _, err := io.ReadFull(conn, fixed[len(headerMagic):]); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	hdr, err = readHeaderBody(conn, fixed[len(headerMagic):])
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, nil, errors.WithStack(conn.SetReadDeadline(time.Time{}))
+}
+
+// WriteReply sends a single status byte in response to a header.
+func WriteReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{code})
+	return errors.WithStack(err)
+}
+
+// ReadReply waits for the status byte answering a header and converts
+// failures into an error.
+func ReadReply(r io.Reader) (byte, error) {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return ReplyFailure, errors.WithStack(err)
+	}
+	switch code[0] {
+	case ReplyOK:
+		return ReplyOK, nil
+	case ReplyNotAllowed:
+		return code[0], ErrNotAllowed
+	default:
+		return code[0], errors.Errorf("destination failed with reply code %d", code[0])
+	}
+}
+
+// ReplyCode maps a dial error to the reply code reported to the peer.
+func ReplyCode(err error) byte {
+	if err == nil {
+		return ReplyOK
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ReplyTimeout
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return ReplyRefused
+		}
+		return ReplyUnreachable
+	}
+	return ReplyFailure
+}
+
+// PrefixConn replays bytes consumed by ProbeHeader before reading from the
+// underlying connection again.
+type PrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// NewPrefixConn wraps conn so that prefix is returned by the first reads.
+func NewPrefixConn(conn net.Conn, prefix []byte) *PrefixConn {
+	return &PrefixConn{Conn: conn, prefix: prefix}
+}
+
+func (c *PrefixConn) Read(p []byte) (n int, err error) {
+	if len(c.prefix) > 0 {
+		n = copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *PrefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
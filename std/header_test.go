@@ -0,0 +1,154 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	want := &Header{Network: "tcp", Addr: "10.0.0.1:22", Comp: true, Src: "192.0.2.1:5000", Dst: "[2001:db8::1]:22", Group: "\x00\xff0123456789abcd", Legs: 2, Resume: "0123456789abcdef", Reattach: true}
+	buf, err := want.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+
+	got, err := ReadHeader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %v", err)
+	}
+	if *got != *want {
+		t.Fatalf("header mismatch: got %+v want %+v", got, want)
+	}
+}
+
+func TestHeaderSkipsUnknownAttributes(t *testing.T) {
+	buf, err := (&Header{Addr: "host:1"}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	// append an attribute this version does not know about
+	buf = append(buf, 0x7f, 3, 'x', 'y', 'z')
+	buf[len(headerMagic)+1] += 5
+
+	got, err := ReadHeader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %v", err)
+	}
+	if got.Addr != "host:1" {
+		t.Fatalf("unexpected addr: %q", got.Addr)
+	}
+}
+
+func TestProbeHeaderPresent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		WriteHeader(client, &Header{Network: "tcp", Addr: "example.com:443"})
+		client.Write([]byte("payload"))
+	}()
+
+	hdr, prefix, err := ProbeHeader(server, time.Second)
+	if err != nil {
+		t.Fatalf("ProbeHeader returned error: %v", err)
+	}
+	if hdr == nil || hdr.Addr != "example.com:443" {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	if len(prefix) != 0 {
+		t.Fatalf("unexpected prefix: %q", prefix)
+	}
+
+	buf := make([]byte, len("payload"))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "payload" {
+		t.Fatalf("payload not preserved: %q %v", buf, err)
+	}
+}
+
+func TestProbeHeaderLegacyStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+
+	hdr, prefix, err := ProbeHeader(server, time.Second)
+	if err != nil {
+		t.Fatalf("ProbeHeader returned error: %v", err)
+	}
+	if hdr != nil {
+		t.Fatalf("expected no header, got %+v", hdr)
+	}
+
+	conn := NewPrefixConn(server, prefix)
+	buf := make([]byte, len("SSH-2.0-OpenSSH\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-OpenSSH\r\n" {
+		t.Fatalf("legacy payload not replayed: %q %v", buf, err)
+	}
+}
+
+func TestProbeHeaderSilentPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	hdr, prefix, err := ProbeHeader(server, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ProbeHeader returned error: %v", err)
+	}
+	if hdr != nil || len(prefix) != 0 {
+		t.Fatalf("expected a silent legacy stream, got %+v %q", hdr, prefix)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}
+
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{nil, ReplyOK},
+		{refused, ReplyRefused},
+		{unreachable, ReplyUnreachable},
+		{errors.New("other"), ReplyFailure},
+	}
+	for _, tt := range tests {
+		if got := ReplyCode(tt.err); got != tt.want {
+			t.Errorf("ReplyCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+
+	if _, err := ReadReply(bytes.NewReader([]byte{ReplyNotAllowed})); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("ReadReply expected ErrNotAllowed, got %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// Connection migration lets a session survive a change of the client's
+// address, eg: a laptop moving from Wi-Fi to LTE. The client tags each of
+// its sockets with a random token, and announces it to the server from
+// wherever it currently sends from:
+//
+//	+-------+-------+-------+------+
+//	| MAGIC | TOKEN | STAMP | MAC  |
+//	|  8B   |  16B  |  8B   | 16B  |
+//	+-------+-------+-------+------+
+//
+// MAC is a truncated HMAC-SHA256 of the rest, keyed with the pre-shared
+// key, and STAMP must grow with every announcement so they cannot be
+// replayed. The server remembers the address a token was first announced
+// from, and reports the packets of later addresses as coming from there, so
+// the session kcp-go knows by that address carries on. Packets from an
+// address which was not announced pass through unchanged, only the
+// announcements are authenticated. The exception are the packets of a
+// session already announced, eg: sent from a new address before the
+// announcement of it: kcp-go would set up a second session for them.
+var announceMagic = [8]byte{0xfb, 'k', 'c', 'p', 'm', 'i', 'g', 0x01}
+
+const (
+	announceTokenSize = 16
+	announceMACSize   = 16
+	announceSize      = len(announceMagic) + announceTokenSize + 8 + announceMACSize
+)
+
+// The layout of the packets of kcp-go, see packetConv.
+const (
+	kcpNonceSize    = 16 // random nonce ahead of every encrypted packet
+	kcpCRCSize      = 4  // CRC32 of the packet after the nonce
+	kcpFECHeader    = 8  // FEC header, followed by the conversation in data and OOB packets
+	kcpOverhead     = 24 // header of a KCP segment, starting with the conversation
+	kcpFECData      = 0xf1
+	kcpFECParity    = 0xf2
+	kcpFECOutOfBand = 0xf3
+)
+
+// Migration statistics, written to the SNMP log.
+var (
+	migrations         = NewCounter("Migrations")         // sessions moved to a new client address
+	migrationsRejected = NewCounter("MigrationsRejected") // announcements failing authentication or replayed
+	migrationsHeld     = NewCounter("MigrationsHeld")     // packets of a session dropped until it is announced from their address
+)
+
+// announceMAC authenticates the announcement in msg, MAC excluded.
+func announceMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)[:announceMACSize]
+}
+
+// isAnnouncement tells announcements apart from KCP packets, which never
+// start with the magic in practice.
+func isAnnouncement(p []byte) bool {
+	return len(p) == announceSize && bytes.Equal(p[:len(announceMagic)], announceMagic[:])
+}
+
+// AnnounceConn is the client side of connection migration. It tags the
+// socket of a session with a token which Announce sends to the server.
+// Write errors are swallowed, as a network going away must look like packet
+// loss to KCP instead of ending the session.
+type AnnounceConn struct {
+	net.PacketConn
+	remote net.Addr
+	key    []byte
+	token  [announceTokenSize]byte
+	stamp  atomic.Uint64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewAnnounceConn wraps conn, carrying a session to remote.
+func NewAnnounceConn(conn net.PacketConn, remote net.Addr, key []byte) (*AnnounceConn, error) {
+	c := &AnnounceConn{PacketConn: conn, remote: remote, key: key, die: make(chan struct{})}
+	if _, err := rand.Read(c.token[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.stamp.Store(uint64(time.Now().UnixNano()))
+	return c, nil
+}
+
+// Announce tells the server the address the session is now sent from.
+func (c *AnnounceConn) Announce() error {
+	msg := make([]byte, 0, announceSize)
+	msg = append(msg, announceMagic[:]...)
+	msg = append(msg, c.token[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, c.stamp.Add(1))
+	msg = append(msg, announceMAC(c.key, msg)...)
+	_, err := c.PacketConn.WriteTo(msg, c.remote)
+	return errors.WithStack(err)
+}
+
+// Done is closed when the connection is closed.
+func (c *AnnounceConn) Done() <-chan struct{} { return c.die }
+
+func (c *AnnounceConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(p, addr); err != nil {
+		select {
+		case <-c.die:
+			return 0, err
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (c *AnnounceConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *AnnounceConn) SetReadBuffer(bytes int) error  { return setReadBuffer(c.PacketConn, bytes) }
+func (c *AnnounceConn) SetWriteBuffer(bytes int) error { return setWriteBuffer(c.PacketConn, bytes) }
+func (c *AnnounceConn) SetDSCP(dscp int) error         { return setDSCP(c.PacketConn, dscp) }
+
+// packetConv returns the conversation of the kcp-go packet p, decrypted with
+// block into buf the way kcp-go does. Parity packets of FEC carry none.
+func packetConv(block kcp.BlockCrypt, p, buf []byte) (uint32, bool) {
+	if len(p) > len(buf) {
+		return 0, false
+	}
+	data := p
+	switch b := block.(type) {
+	case nil:
+	case cipher.AEAD:
+		n := b.NonceSize()
+		if len(p) < n+b.Overhead() {
+			return 0, false
+		}
+		plain, err := b.Open(buf[:0], p[:n], p[n:], nil)
+		if err != nil {
+			return 0, false
+		}
+		data = plain
+	default:
+		if len(p) < kcpNonceSize+kcpCRCSize {
+			return 0, false
+		}
+		b.Decrypt(buf[:len(p)], p)
+		data = buf[kcpNonceSize:len(p)]
+		if crc32.ChecksumIEEE(data[kcpCRCSize:]) != binary.LittleEndian.Uint32(data) {
+			return 0, false
+		}
+		data = data[kcpCRCSize:]
+	}
+
+	if len(data) < kcpFECHeader {
+		return 0, false
+	}
+	switch binary.LittleEndian.Uint16(data[4:]) {
+	case kcpFECData, kcpFECOutOfBand:
+		if len(data) < kcpFECHeader+4 {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data[kcpFECHeader:]), true
+	case kcpFECParity:
+		return 0, false
+	default:
+		if len(data) < kcpOverhead {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data), true
+	}
+}
+
+// migratedPeer is a client known by its token.
+type migratedPeer struct {
+	origin  net.Addr // address kcp-go knows the session by
+	current net.Addr // address the client sends from now
+	stamp   uint64
+	seen    time.Time
+
+	conv    uint32 // conversation of the session, once hasConv
+	hasConv bool
+}
+
+// MigrateConn is the server side of connection migration. It follows the
+// announcements of the clients and translates between the address each
+// session started from and the address its client uses now.
+type MigrateConn struct {
+	net.PacketConn
+	key   []byte
+	block kcp.BlockCrypt // of the sessions, to read their conversation
+	bufs  sync.Pool
+
+	mu       sync.Mutex
+	tokens   map[string]*migratedPeer // by token
+	origins  map[string]*migratedPeer // by origin address
+	currents map[string]*migratedPeer // by current address
+	convs    map[uint32]*migratedPeer // by conversation
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMigrateConn wraps conn, accepting the announcements made with key.
+// block is the one of the sessions, it may be nil.
+func NewMigrateConn(conn net.PacketConn, key []byte, block kcp.BlockCrypt) *MigrateConn {
+	c := &MigrateConn{
+		PacketConn: conn,
+		key:        key,
+		block:      block,
+		tokens:     make(map[string]*migratedPeer),
+		origins:    make(map[string]*migratedPeer),
+		currents:   make(map[string]*migratedPeer),
+		convs:      make(map[uint32]*migratedPeer),
+		die:        make(chan struct{}),
+	}
+	c.bufs.New = func() any { return make([]byte, maxPacketSize) }
+	go c.expirePeers()
+	return c
+}
+
+// expirePeers forgets the clients which stopped announcing themselves.
+func (c *MigrateConn) expirePeers() {
+	ticker := time.NewTicker(peerIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			for token, peer := range c.tokens {
+				if time.Since(peer.seen) > peerIdleTimeout {
+					delete(c.tokens, token)
+					forget(c.origins, peer.origin, peer)
+					forget(c.currents, peer.current, peer)
+					if peer.hasConv && c.convs[peer.conv] == peer {
+						delete(c.convs, peer.conv)
+					}
+				}
+			}
+			c.mu.Unlock()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// forget removes addr from m unless it belongs to another peer by now, eg:
+// a client restarted with a new token on the same address.
+func forget(m map[string]*migratedPeer, addr net.Addr, peer *migratedPeer) {
+	if m[addr.String()] == peer {
+		delete(m, addr.String())
+	}
+}
+
+// announced handles an announcement received from addr.
+func (c *MigrateConn) announced(p []byte, addr net.Addr) {
+	body := p[:announceSize-announceMACSize]
+	if !hmac.Equal(announceMAC(c.key, body), p[len(body):]) {
+		migrationsRejected.Inc()
+		return
+	}
+	token := string(body[len(announceMagic) : len(announceMagic)+announceTokenSize])
+	stamp := binary.BigEndian.Uint64(body[len(announceMagic)+announceTokenSize:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peer, ok := c.tokens[token]
+	if !ok {
+		peer = &migratedPeer{origin: addr, current: addr, stamp: stamp, seen: time.Now()}
+		c.tokens[token] = peer
+		c.origins[addr.String()] = peer
+		c.currents[addr.String()] = peer
+		return
+	}
+	if stamp <= peer.stamp {
+		migrationsRejected.Inc()
+		return
+	}
+	peer.stamp, peer.seen = stamp, time.Now()
+
+	if addr.String() == peer.current.String() {
+		return
+	}
+	forget(c.currents, peer.current, peer)
+	peer.current = addr
+	c.currents[addr.String()] = peer
+	migrations.Inc()
+}
+
+func (c *MigrateConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if isAnnouncement(p[:n]) {
+			c.announced(p[:n], addr)
+			continue
+		}
+
+		c.mu.Lock()
+		peer, ok := c.currents[addr.String()]
+		learn := ok && !peer.hasConv
+		check := !ok && len(c.convs) > 0
+		c.mu.Unlock()
+		if ok && !learn {
+			return n, peer.origin, nil
+		}
+		if !learn && !check {
+			return n, addr, nil
+		}
+
+		buf := c.bufs.Get().([]byte)
+		conv, hasConv := packetConv(c.block, p[:n], buf)
+		c.bufs.Put(buf)
+		if !hasConv {
+			if ok {
+				return n, peer.origin, nil
+			}
+			return n, addr, nil
+		}
+
+		c.mu.Lock()
+		if ok { // the first packet of the session since it was announced
+			peer.conv, peer.hasConv = conv, true
+			c.convs[conv] = peer
+			c.mu.Unlock()
+			return n, peer.origin, nil
+		}
+		_, held := c.convs[conv]
+		c.mu.Unlock()
+		if !held {
+			return n, addr, nil
+		}
+		migrationsHeld.Inc()
+	}
+}
+
+func (c *MigrateConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if peer, ok := c.origins[addr.String()]; ok {
+		addr = peer.current
+	}
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *MigrateConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *MigrateConn) SetReadBuffer(bytes int) error  { return setReadBuffer(c.PacketConn, bytes) }
+func (c *MigrateConn) SetWriteBuffer(bytes int) error { return setWriteBuffer(c.PacketConn, bytes) }
+func (c *MigrateConn) SetDSCP(dscp int) error         { return setDSCP(c.PacketConn, dscp) }
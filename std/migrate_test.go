@@ -0,0 +1,222 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestMigrateConn(t *testing.T) {
+	key := []byte("it's a secrect")
+	server := NewMigrateConn(listenLoopback(t), key, nil)
+	defer server.Close()
+	serverAddr := server.LocalAddr()
+
+	first := listenLoopback(t)
+	client, err := NewAnnounceConn(first, serverAddr, key)
+	if err != nil {
+		t.Fatalf("NewAnnounceConn returned error: %v", err)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	read := func() (string, net.Addr, error) {
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, addr, err := server.ReadFrom(buf)
+		return string(buf[:n]), addr, err
+	}
+
+	// Packets from addresses which were never announced pass through.
+	client.WriteTo([]byte("early"), serverAddr)
+	if got, addr, err := read(); err != nil || got != "early" || addr.String() != first.LocalAddr().String() {
+		t.Fatalf("got %q from %v, %v", got, addr, err)
+	}
+
+	if err := client.Announce(); err != nil {
+		t.Fatalf("Announce returned error: %v", err)
+	}
+	client.WriteTo([]byte("hello"), serverAddr)
+	if got, addr, err := read(); err != nil || got != "hello" || addr.String() != first.LocalAddr().String() {
+		t.Fatalf("got %q from %v, %v", got, addr, err)
+	}
+
+	// The client moves to another socket, the session keeps its address.
+	second := listenLoopback(t)
+	client.PacketConn = second
+	migrated := migrations.Load()
+	client.Announce()
+	client.WriteTo([]byte("moved"), serverAddr)
+	if got, addr, err := read(); err != nil || got != "moved" || addr.String() != first.LocalAddr().String() {
+		t.Fatalf("got %q from %v, %v", got, addr, err)
+	}
+	if migrations.Load() != migrated+1 {
+		t.Fatal("migration not counted")
+	}
+
+	// Answers to the session go to where the client is now.
+	server.WriteTo([]byte("answer"), first.LocalAddr())
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := second.ReadFrom(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("client got %q, %v", buf[:n], err)
+	}
+
+	// Replayed and forged announcements are rejected.
+	rejected := migrationsRejected.Load()
+	msg := make([]byte, announceSize)
+	copy(msg, announceMagic[:])
+	copy(msg[len(announceMagic):], client.token[:])
+	body := msg[:announceSize-announceMACSize]
+	copy(msg[len(body):], announceMAC(key, body)) // stamp 0, older than any
+	first.WriteTo(msg, serverAddr)
+	msg[len(msg)-1] ^= 0xff
+	first.WriteTo(msg, serverAddr)
+	read()
+	if migrationsRejected.Load() != rejected+2 {
+		t.Fatalf("rejected %d announcements, want 2", migrationsRejected.Load()-rejected)
+	}
+}
+
+func TestAnnounceConnSwallowsWriteErrors(t *testing.T) {
+	conn := listenLoopback(t)
+	client, err := NewAnnounceConn(conn, conn.LocalAddr(), []byte("key"))
+	if err != nil {
+		t.Fatalf("NewAnnounceConn returned error: %v", err)
+	}
+	conn.Close()
+	if _, err := client.WriteTo([]byte("lost"), conn.LocalAddr()); err != nil {
+		t.Fatalf("write error reported before Close: %v", err)
+	}
+	client.Close()
+	if _, err := client.WriteTo([]byte("lost"), conn.LocalAddr()); err == nil {
+		t.Fatal("no write error after Close")
+	}
+}
+
+// kcpPacket builds a KCP segment of conv, sealed with block as kcp-go does.
+func kcpPacket(block kcp.BlockCrypt, conv uint32, fec bool) []byte {
+	data := make([]byte, kcpOverhead)
+	binary.LittleEndian.PutUint32(data, conv)
+	data[4] = 81 // IKCP_CMD_PUSH
+	if fec {
+		hdr := make([]byte, kcpFECHeader)
+		binary.LittleEndian.PutUint16(hdr[4:], kcpFECData)
+		data = append(hdr, data...)
+	}
+
+	switch b := block.(type) {
+	case nil:
+		return data
+	case cipher.AEAD:
+		nonce := make([]byte, b.NonceSize())
+		rand.Read(nonce)
+		pkt := make([]byte, 0, len(nonce)+len(data)+b.Overhead())
+		return b.Seal(append(pkt, nonce...), nonce, data, nil)
+	default:
+		pkt := make([]byte, kcpNonceSize+kcpCRCSize, kcpNonceSize+kcpCRCSize+len(data))
+		rand.Read(pkt[:kcpNonceSize])
+		binary.LittleEndian.PutUint32(pkt[kcpNonceSize:], crc32.ChecksumIEEE(data))
+		pkt = append(pkt, data...)
+		b.Encrypt(pkt, pkt)
+		return pkt
+	}
+}
+
+func TestPacketConv(t *testing.T) {
+	aes, _ := kcp.NewAESBlockCrypt(make([]byte, 32))
+	gcm, _ := kcp.NewAESGCMCrypt(make([]byte, 16))
+	buf := make([]byte, maxPacketSize)
+	for name, block := range map[string]kcp.BlockCrypt{"null": nil, "aes": aes, "aes-128-gcm": gcm} {
+		for _, fec := range []bool{false, true} {
+			pkt := kcpPacket(block, 42, fec)
+			if conv, ok := packetConv(block, pkt, buf); !ok || conv != 42 {
+				t.Fatalf("%v, fec %v: got conv %d, %v, want 42", name, fec, conv, ok)
+			}
+		}
+	}
+
+	// A packet of another key has no conversation.
+	other, _ := kcp.NewAESBlockCrypt(make([]byte, 32))
+	pkt := kcpPacket(other, 42, false)
+	pkt[len(pkt)-1] ^= 0xff
+	if _, ok := packetConv(aes, pkt, buf); ok {
+		t.Fatal("got a conversation from a corrupted packet")
+	}
+}
+
+func TestMigrateConnHoldsAnnouncedSessions(t *testing.T) {
+	key := []byte("it's a secrect")
+	block, _ := kcp.NewAESBlockCrypt(make([]byte, 32))
+	server := NewMigrateConn(listenLoopback(t), key, block)
+	defer server.Close()
+	serverAddr := server.LocalAddr()
+
+	first := listenLoopback(t)
+	client, err := NewAnnounceConn(first, serverAddr, key)
+	if err != nil {
+		t.Fatalf("NewAnnounceConn returned error: %v", err)
+	}
+	buf := make([]byte, maxPacketSize)
+	read := func() (net.Addr, error) {
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, addr, err := server.ReadFrom(buf)
+		return addr, err
+	}
+
+	client.Announce()
+	client.WriteTo(kcpPacket(block, 42, false), serverAddr)
+	if addr, err := read(); err != nil || addr.String() != first.LocalAddr().String() {
+		t.Fatalf("got packet from %v, %v", addr, err)
+	}
+
+	// Sent from a new address ahead of the announcement, the session is
+	// held back instead of showing up as a second one.
+	second := listenLoopback(t)
+	client.PacketConn = second
+	held := migrationsHeld.Load()
+	client.WriteTo(kcpPacket(block, 42, false), serverAddr)
+	if addr, err := read(); err == nil {
+		t.Fatalf("got packet of an announced session from %v before its announcement", addr)
+	}
+	if migrationsHeld.Load() != held+1 {
+		t.Fatal("held packet not counted")
+	}
+
+	// Other sessions from that address pass through.
+	second.WriteTo(kcpPacket(block, 7, false), serverAddr)
+	if addr, err := read(); err != nil || addr.String() != second.LocalAddr().String() {
+		t.Fatalf("got packet from %v, %v", addr, err)
+	}
+
+	client.Announce()
+	client.WriteTo(kcpPacket(block, 42, false), serverAddr)
+	if addr, err := read(); err != nil || addr.String() != first.LocalAddr().String() {
+		t.Fatalf("got packet from %v, %v", addr, err)
+	}
+}
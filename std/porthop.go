@@ -0,0 +1,363 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Port hopping moves a live session to another port of the server's
+// multiport range, for networks throttling long-lived UDP flows. The client
+// keeps its socket and only changes the destination port, see HopConn, while
+// the server serves all its ports as a single socket, see MultiPortConn, so
+// the session is recognized on whatever port it arrives.
+
+const (
+	// maxPacketSize matches the largest packet kcp-go reads.
+	maxPacketSize = 1500
+
+	// peerIdleTimeout is how long MultiPortConn remembers the port a peer
+	// was last heard on.
+	peerIdleTimeout = 2 * time.Minute
+
+	// maxPortPeers caps the peers MultiPortConn remembers, as any packet
+	// records its source. Beyond it, new peers are answered from the first
+	// socket, which HopConn accepts too.
+	maxPortPeers = 65536
+)
+
+var errReadDeadline = errors.New("read deadlines are not supported")
+
+// HopConn sends the packets of a session to a port that can be changed
+// while it is up. Packets from any port of the server are reported as
+// coming from the address the session was dialed to, so KCP accepts them.
+type HopConn struct {
+	net.PacketConn
+	remote *net.UDPAddr
+	target atomic.Pointer[net.UDPAddr]
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewHopConn wraps conn for a session dialed to remote.
+func NewHopConn(conn net.PacketConn, remote *net.UDPAddr) *HopConn {
+	c := &HopConn{PacketConn: conn, remote: remote, die: make(chan struct{})}
+	c.target.Store(remote)
+	return c
+}
+
+// Hop sends the packets written from now on to port, and returns the port
+// they went to before.
+func (c *HopConn) Hop(port int) int {
+	target := *c.remote
+	target.Port = port
+	return c.target.Swap(&target).Port
+}
+
+// Done is closed when the connection is closed.
+func (c *HopConn) Done() <-chan struct{} { return c.die }
+
+func (c *HopConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if udp, ok := addr.(*net.UDPAddr); ok && udp.IP.Equal(c.remote.IP) {
+		addr = c.remote
+	}
+	return n, addr, err
+}
+
+func (c *HopConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(p, c.target.Load())
+}
+
+func (c *HopConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *HopConn) SetReadBuffer(bytes int) error  { return setReadBuffer(c.PacketConn, bytes) }
+func (c *HopConn) SetWriteBuffer(bytes int) error { return setWriteBuffer(c.PacketConn, bytes) }
+func (c *HopConn) SetDSCP(dscp int) error         { return setDSCP(c.PacketConn, dscp) }
+
+// portPacket is a packet read by MultiPortConn, with the socket it came in.
+type portPacket struct {
+	buf  []byte
+	addr net.Addr
+	conn net.PacketConn
+}
+
+// portPeer is the socket a peer was last heard on.
+type portPeer struct {
+	conn net.PacketConn
+	seen time.Time
+}
+
+// MultiPortConn serves several sockets, usually bound to the ports of a
+// multiport range, as a single one. Packets to a peer leave through the
+// socket it was last heard on, so each peer sees answers from the port it
+// talks to.
+type MultiPortConn struct {
+	packets chan portPacket
+	bufs    sync.Pool
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+	peers map[string]portPeer
+
+	// The socket options set so far, applied to the sockets added later.
+	readBuffer, writeBuffer, dscp int
+
+	readers int32         // sockets still being read, guarded by mu
+	failed  chan struct{} // closed once every socket failed
+	err     error         // the last read error, set before failed is closed
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMultiPortConn starts reading conns.
+func NewMultiPortConn(conns []net.PacketConn) *MultiPortConn {
+	c := &MultiPortConn{
+		conns:   conns,
+		packets: make(chan portPacket, 1024),
+		peers:   make(map[string]portPeer),
+		failed:  make(chan struct{}),
+		die:     make(chan struct{}),
+	}
+	c.bufs.New = func() any { return make([]byte, maxPacketSize) }
+	c.readers = int32(len(conns))
+	for _, conn := range conns {
+		go c.read(conn)
+	}
+	go c.expirePeers()
+	return c
+}
+
+// read feeds the packets of conn to ReadFrom until conn fails.
+func (c *MultiPortConn) read(conn net.PacketConn) {
+	for {
+		buf := c.bufs.Get().([]byte)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.bufs.Put(buf)
+			c.mu.Lock()
+			if c.readers--; c.readers == 0 {
+				c.err = errors.WithStack(err)
+				close(c.failed)
+			}
+			c.mu.Unlock()
+			return
+		}
+		select {
+		case c.packets <- portPacket{buf[:n], addr, conn}:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// Add serves conn as well, eg: a port of the range which could only be
+// bound later on. It fails once the connection is closed or failed.
+func (c *MultiPortConn) Add(conn net.PacketConn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.die:
+		return errors.WithStack(net.ErrClosed)
+	case <-c.failed:
+		return c.err
+	default:
+	}
+	if c.readBuffer > 0 {
+		setReadBuffer(conn, c.readBuffer)
+	}
+	if c.writeBuffer > 0 {
+		setWriteBuffer(conn, c.writeBuffer)
+	}
+	if c.dscp > 0 {
+		setDSCP(conn, c.dscp)
+	}
+	c.conns = append(c.conns, conn)
+	c.readers++
+	go c.read(conn)
+	return nil
+}
+
+// Done is closed when the connection is closed.
+func (c *MultiPortConn) Done() <-chan struct{} { return c.die }
+
+// expirePeers forgets the peers which have not been heard of for a while.
+func (c *MultiPortConn) expirePeers() {
+	ticker := time.NewTicker(peerIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			for key, peer := range c.peers {
+				if time.Since(peer.seen) > peerIdleTimeout {
+					delete(c.peers, key)
+				}
+			}
+			c.mu.Unlock()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *MultiPortConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.packets:
+		n := copy(p, pkt.buf)
+		c.bufs.Put(pkt.buf[:cap(pkt.buf)])
+		key := pkt.addr.String()
+		c.mu.Lock()
+		if _, ok := c.peers[key]; ok || len(c.peers) < maxPortPeers {
+			c.peers[key] = portPeer{pkt.conn, time.Now()}
+		}
+		c.mu.Unlock()
+		return n, pkt.addr, nil
+	case <-c.failed:
+		return 0, nil, c.err
+	case <-c.die:
+		return 0, nil, errors.WithStack(net.ErrClosed)
+	}
+}
+
+func (c *MultiPortConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	conn := c.conns[0]
+	if peer, ok := c.peers[addr.String()]; ok {
+		conn = peer.conn
+	}
+	c.mu.Unlock()
+	return conn.WriteTo(p, addr)
+}
+
+func (c *MultiPortConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dieOnce.Do(func() { close(c.die) })
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the address of the first socket.
+func (c *MultiPortConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns[0].LocalAddr()
+}
+
+func (c *MultiPortConn) SetDeadline(t time.Time) error { return errReadDeadline }
+
+func (c *MultiPortConn) SetReadDeadline(t time.Time) error { return errReadDeadline }
+
+func (c *MultiPortConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MultiPortConn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBuffer = bytes
+	for _, conn := range c.conns {
+		if err := setReadBuffer(conn, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MultiPortConn) SetWriteBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeBuffer = bytes
+	for _, conn := range c.conns {
+		if err := setWriteBuffer(conn, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MultiPortConn) SetDSCP(dscp int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dscp = dscp
+	for _, conn := range c.conns {
+		if err := setDSCP(conn, dscp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setReadBuffer, setWriteBuffer and setDSCP pass the socket options kcp-go
+// sets on its connection on to a wrapped one.
+func setReadBuffer(conn net.PacketConn, bytes int) error {
+	if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		return c.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer not supported")
+}
+
+func setWriteBuffer(conn net.PacketConn, bytes int) error {
+	if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return c.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer not supported")
+}
+
+func setDSCP(conn net.PacketConn, dscp int) error {
+	if c, ok := conn.(interface{ SetDSCP(int) error }); ok {
+		return c.SetDSCP(dscp)
+	}
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return errors.New("SetDSCP not supported")
+	}
+	err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+	err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+	if err4 != nil && err6 != nil {
+		return errors.WithStack(err4)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP returned error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPortHopping(t *testing.T) {
+	a, b := listenLoopback(t), listenLoopback(t)
+	server := NewMultiPortConn([]net.PacketConn{a, b})
+	defer server.Close()
+	addrA, addrB := a.LocalAddr().(*net.UDPAddr), b.LocalAddr().(*net.UDPAddr)
+
+	client := NewHopConn(listenLoopback(t), addrA)
+	defer client.Close()
+
+	buf := make([]byte, maxPacketSize)
+	roundTrip := func(want *net.UDPAddr) {
+		t.Helper()
+		if _, err := client.WriteTo([]byte("ping"), addrA); err != nil {
+			t.Fatalf("WriteTo returned error: %v", err)
+		}
+		n, from, err := server.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("server read %q, %v", buf[:n], err)
+		}
+		if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+			t.Fatalf("WriteTo returned error: %v", err)
+		}
+
+		// The answer leaves through the port the client talks to, and is
+		// reported as coming from the address the client dialed.
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err = client.PacketConn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("client read %q, %v", buf[:n], err)
+		}
+		if from.(*net.UDPAddr).Port != want.Port {
+			t.Fatalf("answer from port %d, want %d", from.(*net.UDPAddr).Port, want.Port)
+		}
+	}
+
+	roundTrip(addrA)
+	if from := client.Hop(addrB.Port); from != addrA.Port {
+		t.Fatalf("Hop returned port %d, want %d", from, addrA.Port)
+	}
+	roundTrip(addrB)
+
+	// Packets from the new port are reported as coming from the old one.
+	b.WriteTo([]byte("late"), client.LocalAddr())
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, from, err := client.ReadFrom(buf); err != nil || from.String() != addrA.String() {
+		t.Fatalf("got packet from %v, %v, want %v", from, err, addrA)
+	}
+}
+
+func TestMultiPortConnClose(t *testing.T) {
+	server := NewMultiPortConn([]net.PacketConn{listenLoopback(t), listenLoopback(t)})
+	done := make(chan error)
+	go func() {
+		_, _, err := server.ReadFrom(make([]byte, maxPacketSize))
+		done <- err
+	}()
+	server.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("ReadFrom returned no error after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom still blocked after Close")
+	}
+}
+
+func TestMultiPortConnAdd(t *testing.T) {
+	server := NewMultiPortConn([]net.PacketConn{listenLoopback(t)})
+	late := listenLoopback(t)
+	if err := server.Add(late); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+
+	// A port added later on is served as well.
+	client := listenLoopback(t)
+	client.WriteTo([]byte("ping"), late.LocalAddr())
+	buf := make([]byte, maxPacketSize)
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("server read %q, %v", buf[:n], err)
+	}
+
+	server.Close()
+	if err := server.Add(listenLoopback(t)); err == nil {
+		t.Fatal("Add returned no error after Close")
+	}
+}
+
+func TestMultiPortConnPeerCap(t *testing.T) {
+	a, b := listenLoopback(t), listenLoopback(t)
+	server := NewMultiPortConn([]net.PacketConn{a, b})
+	defer server.Close()
+
+	// Fill the peers with junk sources.
+	server.mu.Lock()
+	for i := 0; i < maxPortPeers; i++ {
+		server.peers[fmt.Sprint("junk", i)] = portPeer{a, time.Now()}
+	}
+	server.mu.Unlock()
+
+	// A new peer is not recorded, and answered from the first socket.
+	client := listenLoopback(t)
+	client.WriteTo([]byte("ping"), b.LocalAddr())
+	buf := make([]byte, maxPacketSize)
+	_, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom returned error: %v", err)
+	}
+	server.mu.Lock()
+	n := len(server.peers)
+	server.mu.Unlock()
+	if n != maxPortPeers {
+		t.Fatalf("%d peers recorded, want %d", n, maxPortPeers)
+	}
+	server.WriteTo([]byte("pong"), from)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, src, err := client.ReadFrom(buf)
+	if err != nil || src.String() != a.LocalAddr().String() {
+		t.Fatalf("answer from %v, %v, want %v", src, err, a.LocalAddr())
+	}
+}
@@ -0,0 +1,188 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PROXY protocol versions, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	ProxyV1 = 1 // human-readable text header
+	ProxyV2 = 2 // binary header
+)
+
+// proxyV2Sig starts every PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// MarshalProxyHeader builds a PROXY protocol header telling the backend that
+// the connection comes from src and was addressed to dst. When either address
+// is unknown the header says so, and the backend falls back to the address
+// of the connection itself.
+func MarshalProxyHeader(version int, src, dst netip.AddrPort) ([]byte, error) {
+	known := src.IsValid() && dst.IsValid()
+	if known {
+		// Both ends must belong to the same family, IPv4 addresses are
+		// mapped into IPv6 when the other one is IPv6.
+		srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+		if srcAddr.Is4() != dstAddr.Is4() {
+			srcAddr, dstAddr = netip.AddrFrom16(srcAddr.As16()), netip.AddrFrom16(dstAddr.As16())
+		}
+		src, dst = netip.AddrPortFrom(srcAddr, src.Port()), netip.AddrPortFrom(dstAddr, dst.Port())
+	}
+
+	switch version {
+	case ProxyV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if src.Addr().Is4() {
+			proto = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port()), nil
+
+	case ProxyV2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Sig)
+		if !known {
+			// LOCAL command, no address block
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+
+		buf.WriteByte(0x21) // version 2, PROXY command
+		if src.Addr().Is4() {
+			buf.WriteByte(0x11) // AF_INET, STREAM
+			buf.Write(binary.BigEndian.AppendUint16(nil, 12))
+		} else {
+			buf.WriteByte(0x21) // AF_INET6, STREAM
+			buf.Write(binary.BigEndian.AppendUint16(nil, 36))
+		}
+		buf.Write(src.Addr().AsSlice())
+		buf.Write(dst.Addr().AsSlice())
+		buf.Write(binary.BigEndian.AppendUint16(nil, src.Port()))
+		buf.Write(binary.BigEndian.AppendUint16(nil, dst.Port()))
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Errorf("unsupported PROXY protocol version: %d", version)
+}
+
+// maxProxyV1Size is the longest PROXY protocol v1 line, CRLF included.
+const maxProxyV1Size = 107
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from r and returns
+// the addresses it announces. It reads exactly the header, so the payload is
+// left on r. Headers announcing no addresses (UNKNOWN, LOCAL, or families
+// other than TCP over IPv4/IPv6) return zero addresses and no error.
+func ReadProxyHeader(r io.Reader) (src, dst netip.AddrPort, err error) {
+	var sig [12]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return src, dst, errors.WithStack(err)
+	}
+	if bytes.Equal(sig[:], proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig[:], []byte("PROXY ")) {
+		return src, dst, errors.New("not a PROXY protocol header")
+	}
+
+	// v1: read the rest of the line a byte at a time, so nothing past the
+	// CRLF is consumed.
+	line := append([]byte(nil), sig[:]...)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Size {
+			return src, dst, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return src, dst, errors.WithStack(err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return src, dst, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return src, dst, errors.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	if src, err = netip.ParseAddrPort(net.JoinHostPort(fields[2], fields[4])); err != nil {
+		return src, dst, errors.WithStack(err)
+	}
+	if dst, err = netip.ParseAddrPort(net.JoinHostPort(fields[3], fields[5])); err != nil {
+		return src, dst, errors.WithStack(err)
+	}
+	return src, dst, nil
+}
+
+// readProxyV2 reads the part of a v2 header following its signature.
+func readProxyV2(r io.Reader) (src, dst netip.AddrPort, err error) {
+	var fixed [4]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return src, dst, errors.WithStack(err)
+	}
+	if fixed[0]>>4 != 2 {
+		return src, dst, errors.Errorf("unsupported PROXY protocol version: %d", fixed[0]>>4)
+	}
+
+	// The address block and any TLVs are always consumed entirely.
+	block := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if _, err := io.ReadFull(r, block); err != nil {
+		return src, dst, errors.WithStack(err)
+	}
+
+	switch cmd := fixed[0] & 0x0f; cmd {
+	case 0x00: // LOCAL, e.g. health checks of the proxy itself
+		return src, dst, nil
+	case 0x01: // PROXY
+	default:
+		return src, dst, errors.Errorf("unsupported PROXY protocol command: %d", cmd)
+	}
+
+	switch fixed[1] {
+	case 0x11: // TCP over IPv4
+		if len(block) < 12 {
+			return src, dst, errors.New("truncated PROXY protocol v2 header")
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(block[0:4])), binary.BigEndian.Uint16(block[8:10]))
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(block[4:8])), binary.BigEndian.Uint16(block[10:12]))
+	case 0x21: // TCP over IPv6
+		if len(block) < 36 {
+			return src, dst, errors.New("truncated PROXY protocol v2 header")
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(block[0:16])), binary.BigEndian.Uint16(block[32:34]))
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(block[16:32])), binary.BigEndian.Uint16(block[34:36]))
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,150 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestMarshalProxyHeaderV1(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst string
+		want     string
+	}{
+		{"192.0.2.1:5000", "198.51.100.1:443", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 443\r\n"},
+		{"[2001:db8::1]:5000", "[2001:db8::2]:443", "PROXY TCP6 2001:db8::1 2001:db8::2 5000 443\r\n"},
+		{"[::ffff:192.0.2.1]:5000", "198.51.100.1:443", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 443\r\n"},
+		{"192.0.2.1:5000", "[2001:db8::2]:443", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 5000 443\r\n"},
+	} {
+		buf, err := MarshalProxyHeader(ProxyV1, netip.MustParseAddrPort(tc.src), netip.MustParseAddrPort(tc.dst))
+		if err != nil {
+			t.Fatalf("MarshalProxyHeader returned error: %v", err)
+		}
+		if string(buf) != tc.want {
+			t.Fatalf("got %q want %q", buf, tc.want)
+		}
+	}
+
+	buf, err := MarshalProxyHeader(ProxyV1, netip.AddrPort{}, netip.MustParseAddrPort("198.51.100.1:443"))
+	if err != nil || string(buf) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("unexpected header for unknown source: %q %v", buf, err)
+	}
+}
+
+func TestMarshalProxyHeaderV2(t *testing.T) {
+	buf, err := MarshalProxyHeader(ProxyV2, netip.MustParseAddrPort("192.0.2.1:5000"), netip.MustParseAddrPort("198.51.100.1:443"))
+	if err != nil {
+		t.Fatalf("MarshalProxyHeader returned error: %v", err)
+	}
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+		0x13, 0x88,
+		0x01, 0xbb)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("got % x want % x", buf, want)
+	}
+
+	buf, err = MarshalProxyHeader(ProxyV2, netip.MustParseAddrPort("[2001:db8::1]:5000"), netip.MustParseAddrPort("[2001:db8::2]:443"))
+	if err != nil {
+		t.Fatalf("MarshalProxyHeader returned error: %v", err)
+	}
+	if len(buf) != 16+36 || buf[13] != 0x21 || buf[15] != 36 {
+		t.Fatalf("unexpected IPv6 header: % x", buf)
+	}
+
+	buf, err = MarshalProxyHeader(ProxyV2, netip.AddrPort{}, netip.AddrPort{})
+	if err != nil || len(buf) != 16 || buf[12] != 0x20 {
+		t.Fatalf("unexpected LOCAL header: % x %v", buf, err)
+	}
+
+	if _, err := MarshalProxyHeader(3, netip.AddrPort{}, netip.AddrPort{}); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:5000"), netip.MustParseAddrPort("198.51.100.1:443")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:5000"), netip.MustParseAddrPort("[2001:db8::2]:443")
+
+	for _, version := range []int{ProxyV1, ProxyV2} {
+		for _, tc := range [][2]netip.AddrPort{{src, dst}, {src6, dst6}, {}} {
+			buf, err := MarshalProxyHeader(version, tc[0], tc[1])
+			if err != nil {
+				t.Fatalf("MarshalProxyHeader returned error: %v", err)
+			}
+			r := bytes.NewReader(append(buf, "payload"...))
+
+			gotSrc, gotDst, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Fatalf("v%d: ReadProxyHeader returned error: %v", version, err)
+			}
+			if gotSrc != tc[0] || gotDst != tc[1] {
+				t.Fatalf("v%d: got %v %v want %v %v", version, gotSrc, gotDst, tc[0], tc[1])
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("v%d: payload was consumed: %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeaderSkipsTLVs(t *testing.T) {
+	buf := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x11,
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+		0x13, 0x88,
+		0x01, 0xbb,
+		0x04, 0x00, 0x02, 'h', 'i') // PP2_TYPE_NOOP
+	r := bytes.NewReader(append(buf, 'x'))
+
+	src, _, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader returned error: %v", err)
+	}
+	if src.String() != "192.0.2.1:5000" {
+		t.Fatalf("unexpected source: %v", src)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "x" {
+		t.Fatalf("unexpected payload: %q", rest)
+	}
+}
+
+func TestReadProxyHeaderRejectsGarbage(t *testing.T) {
+	for _, input := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 5000 70000\r\n",
+		"PROXY " + strings.Repeat("x", 200),
+	} {
+		if _, _, err := ReadProxyHeader(strings.NewReader(input)); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RateLog logs at most one line per interval, so a flood of clients being
+// rejected cannot flood the log as well. The lines dropped meanwhile are
+// counted and reported with the next one.
+type RateLog struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	last    time.Time
+	dropped int
+}
+
+// NewRateLog returns a RateLog writing at most one line per interval.
+func NewRateLog(interval time.Duration) *RateLog {
+	return &RateLog{interval: interval}
+}
+
+// Println logs v like log.Println, unless a line was written less than the
+// interval ago.
+func (r *RateLog) Println(v ...any) {
+	r.mu.Lock()
+	now := time.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < r.interval {
+		r.dropped++
+		r.mu.Unlock()
+		return
+	}
+	r.last = now
+	dropped := r.dropped
+	r.dropped = 0
+	r.mu.Unlock()
+
+	if dropped > 0 {
+		v = append(v, fmt.Sprintf("(%d more suppressed)", dropped))
+	}
+	log.Output(2, fmt.Sprintln(v...))
+}
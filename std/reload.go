@@ -0,0 +1,191 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// LiveKCPFields are the config fields TuneKCP applies, a reload changes
+// them on the running sessions.
+var LiveKCPFields = []string{"mode", "nodelay", "interval", "resend", "nc", "mtu", "sndwnd", "rcvwnd", "acknodelay", "ratelimit"}
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func()
+
+	// watchReload subscribes to SIGHUP, where the platform has it.
+	watchReload = func() {}
+
+	// tuning holds the KCP settings of the last reload, nil before any.
+	tuning      atomic.Pointer[BaseConfig]
+	kcpSessions = make(map[*kcp.UDPSession]struct{})
+	logFile     *os.File
+)
+
+// OnReload registers fn to be called on SIGHUP. SIGHUP ends the process
+// as usual until a first function is registered.
+func OnReload(fn func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+	watchReload()
+}
+
+// reload runs the functions registered with OnReload.
+func reload() {
+	reloadMu.Lock()
+	hooks := reloadHooks
+	reloadMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// TuneKCP applies the KCP settings of c to conn, or those of the last
+// RetuneKCP when a reload changed them, and keeps conn tuned by later
+// reloads until untrack is called.
+func (c *BaseConfig) TuneKCP(conn *kcp.UDPSession) (untrack func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if t := tuning.Load(); t != nil {
+		c = t
+	}
+	c.tune(conn)
+	kcpSessions[conn] = struct{}{}
+	return func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		delete(kcpSessions, conn)
+	}
+}
+
+// RetuneKCP applies the KCP settings of c to the running sessions and to
+// those created from now on. It returns the number of sessions changed.
+func RetuneKCP(c *BaseConfig) int {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	t := *c
+	tuning.Store(&t)
+	for conn := range kcpSessions {
+		t.tune(conn)
+	}
+	return len(kcpSessions)
+}
+
+func (c *BaseConfig) tune(conn *kcp.UDPSession) {
+	conn.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
+	conn.SetWindowSize(c.SndWnd, c.RcvWnd)
+	conn.SetMtu(c.MTU)
+	conn.SetACKNoDelay(c.AckNodelay)
+	conn.SetRateLimit(uint32(c.RateLimit))
+}
+
+// OpenLog sends the log to the file at path, or to stderr when path is
+// empty, closing the file it was sent to before.
+func OpenLog(path string) error {
+	var w io.Writer = os.Stderr
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+			return errors.WithStack(err)
+		}
+		w = f
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	log.SetOutput(w)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// ReadConfig reads the config file at path over a copy of base into next,
+// both pointers to the same config type. Decoding into a plain copy would
+// overwrite the slices of base.
+func ReadConfig(next, base any, path string) error {
+	buf, err := json.Marshal(base)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := json.Unmarshal(buf, next); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ParseJSONConfig(next, path))
+}
+
+// ChangedFields compares two configs of the same struct type, fields of
+// embedded structs included, and returns the json names of those which
+// differ.
+func ChangedFields(old, new any) []string {
+	var changed []string
+	walkFields(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), func(name string, a, b reflect.Value) {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			changed = append(changed, name)
+		}
+	})
+	return changed
+}
+
+// CopyFields sets the fields of dst named by their json names to their
+// values in src, both pointers to the same struct type.
+func CopyFields(dst, src any, names []string) {
+	walkFields(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem(), func(name string, d, s reflect.Value) {
+		for _, n := range names {
+			if n == name {
+				d.Set(s)
+			}
+		}
+	})
+}
+
+// walkFields calls fn with the json name of every field of a and b,
+// descending into embedded structs.
+func walkFields(a, b reflect.Value, fn func(name string, a, b reflect.Value)) {
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			walkFields(a.Field(i), b.Field(i), fn)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		fn(name, a.Field(i), b.Field(i))
+	}
+}
@@ -0,0 +1,67 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type reloadTestConfig struct {
+	BaseConfig
+	Target  string   `json:"target"`
+	Reverse []string `json:"reverse"`
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"target": "10.0.0.1:22", "ratelimit": 100, "reverse": ["b=:2"]}`), 0o644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+
+	base := reloadTestConfig{Target: "127.0.0.1:22", Reverse: make([]string, 1, 4)}
+	base.Reverse[0] = "a=:1"
+	base.Key = "secret"
+	var next reloadTestConfig
+	if err := ReadConfig(&next, &base, path); err != nil {
+		t.Fatalf("ReadConfig returned error: %v", err)
+	}
+	if next.Target != "10.0.0.1:22" || next.RateLimit != 100 || next.Key != "secret" {
+		t.Fatalf("unexpected config: %+v", next)
+	}
+	if base.Reverse[:2][1] != "" || base.Reverse[0] != "a=:1" {
+		t.Fatalf("ReadConfig wrote to the slices of base: %q", base.Reverse[:2])
+	}
+
+	changed := ChangedFields(&base, &next)
+	if want := []string{"ratelimit", "target", "reverse"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("got changed fields %q, want %q", changed, want)
+	}
+
+	CopyFields(&base, &next, []string{"ratelimit", "target"})
+	if base.RateLimit != 100 || base.Target != "10.0.0.1:22" || base.Reverse[0] != "a=:1" {
+		t.Fatalf("unexpected fields copied: %+v", base)
+	}
+}
@@ -0,0 +1,405 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A resumable stream outlives the smux stream carrying it, its leg. Each
+// side keeps the bytes it sent until the peer acknowledges them, so when a
+// session dies the stream carries on over a new leg, usually on a new
+// session, from where the peer stopped receiving. Frames on a leg:
+//
+//	DATA: 0x00 | LEN 2B | PAYLOAD
+//	ACK:  0x01 | bytes received so far, 8B
+//	FIN:  0x02, no more data in this direction
+//	FIN ACK: 0x03, the FIN and everything before it were received
+//
+// A leg starts with both sides sending the number of bytes they received
+// so far, then the unacknowledged bytes are sent again.
+const (
+	resumeData   = 0x00
+	resumeAck    = 0x01
+	resumeFin    = 0x02
+	resumeFinAck = 0x03
+
+	resumeMaxPayload = 16 * 1024
+
+	// ResumeBufferSize bounds the unacknowledged bytes kept per direction,
+	// writes block beyond it until the peer caught up.
+	ResumeBufferSize = 1 << 20
+
+	// resumeAckEvery is how many bytes are received between two ACKs.
+	resumeAckEvery = 64 * 1024
+)
+
+// Resumable stream statistics, written to the SNMP log.
+var (
+	resumeAttached = NewCounter("ResumeAttached") // legs attached to a stream after its first one
+	resumeResent   = NewCounter("ResumeResent")   // bytes sent again on a new leg
+)
+
+// ResumeConn is one side of a resumable stream, see Attach.
+type ResumeConn struct {
+	wmu sync.Mutex // serializes the frames written on the leg
+	rmu sync.Mutex // serializes the delivery of received data
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	leg      io.ReadWriteCloser
+	gen      int           // bumped with every leg, frames of older legs are ignored
+	broken   chan struct{} // closed when the current leg fails
+	unacked  []byte        // bytes sent and not acknowledged yet
+	acked    uint64        // stream offset of unacked[0]
+	finSent  bool
+	finAcked bool
+	recvd    uint64 // bytes received and delivered
+	ackSent  uint64 // recvd at the last ACK
+	finRcvd  bool
+	closed   bool
+	die      chan struct{}
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+// NewResumeConn creates a resumable stream without a leg.
+func NewResumeConn() *ResumeConn {
+	c := &ResumeConn{broken: make(chan struct{}), die: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	c.pr, c.pw = io.Pipe()
+	return c
+}
+
+// Broken is closed when the current leg failed and another one must be
+// attached for the stream to go on.
+func (c *ResumeConn) Broken() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.broken
+}
+
+// Done is closed when the stream is closed.
+func (c *ResumeConn) Done() <-chan struct{} { return c.die }
+
+// Attach carries the stream over leg from now on, closing the previous leg
+// if any. Both sides must attach the same leg.
+func (c *ResumeConn) Attach(leg io.ReadWriteCloser) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		leg.Close()
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+	first := c.gen == 0
+	c.gen++
+	gen := c.gen
+	if c.leg != nil {
+		c.leg.Close()
+		c.leg = nil
+	}
+	c.mu.Unlock()
+
+	// Wait for the old leg to finish delivering, data past recvd would be
+	// sent again on the new leg.
+	c.rmu.Lock()
+	c.mu.Lock()
+	recvd := c.recvd
+	c.ackSent = recvd
+	c.mu.Unlock()
+	c.rmu.Unlock()
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], recvd)
+	if _, err := leg.Write(buf[:]); err != nil {
+		leg.Close()
+		return errors.WithStack(err)
+	}
+	if _, err := io.ReadFull(leg, buf[:]); err != nil {
+		leg.Close()
+		return errors.WithStack(err)
+	}
+	peerRecvd := binary.BigEndian.Uint64(buf[:])
+
+	c.mu.Lock()
+	if c.closed || gen != c.gen {
+		c.mu.Unlock()
+		leg.Close()
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+	if peerRecvd < c.acked || peerRecvd > c.acked+uint64(len(c.unacked)) {
+		c.mu.Unlock()
+		leg.Close()
+		return errors.Errorf("resume from byte %d outside of the buffered %d-%d", peerRecvd, c.acked, c.acked+uint64(len(c.unacked)))
+	}
+	c.unacked = c.unacked[peerRecvd-c.acked:]
+	c.acked = peerRecvd
+	c.cond.Broadcast()
+	pending := c.unacked
+	fin := c.finSent
+	c.leg = leg
+	select {
+	case <-c.broken:
+		c.broken = make(chan struct{})
+	default:
+	}
+	c.mu.Unlock()
+
+	if !first {
+		resumeAttached.Inc()
+	}
+	go c.readLeg(leg, gen)
+
+	// Send again what the peer missed; the buffer is only ever trimmed at
+	// its front, so pending stays valid.
+	for len(pending) > 0 {
+		n := min(len(pending), resumeMaxPayload)
+		if err := c.writeFrame(leg, gen, resumeData, pending[:n]); err != nil {
+			return nil
+		}
+		resumeResent.Add(uint64(n))
+		pending = pending[n:]
+	}
+	if fin {
+		c.writeFrame(leg, gen, resumeFin, nil)
+	}
+	return nil
+}
+
+// readLeg handles the frames arriving on leg until it fails.
+func (c *ResumeConn) readLeg(leg io.ReadWriter, gen int) {
+	var hdr [9]byte
+	buf := make([]byte, resumeMaxPayload)
+	for {
+		if _, err := io.ReadFull(leg, hdr[:1]); err != nil {
+			c.legFailed(gen)
+			return
+		}
+		switch hdr[0] {
+		case resumeData:
+			if _, err := io.ReadFull(leg, hdr[1:3]); err != nil {
+				c.legFailed(gen)
+				return
+			}
+			n := int(binary.BigEndian.Uint16(hdr[1:3]))
+			if n > resumeMaxPayload {
+				c.legFailed(gen)
+				return
+			}
+			if _, err := io.ReadFull(leg, buf[:n]); err != nil {
+				c.legFailed(gen)
+				return
+			}
+			if !c.deliver(gen, buf[:n]) {
+				return
+			}
+		case resumeAck:
+			if _, err := io.ReadFull(leg, hdr[1:9]); err != nil {
+				c.legFailed(gen)
+				return
+			}
+			c.acknowledged(binary.BigEndian.Uint64(hdr[1:9]))
+		case resumeFin:
+			c.rmu.Lock()
+			c.mu.Lock()
+			if gen == c.gen && !c.finRcvd {
+				c.finRcvd = true
+				c.pw.Close()
+			}
+			c.mu.Unlock()
+			c.rmu.Unlock()
+			c.wmu.Lock()
+			c.writeFrame(leg, gen, resumeFinAck, nil)
+			c.wmu.Unlock()
+		case resumeFinAck:
+			c.mu.Lock()
+			c.finAcked = true
+			c.mu.Unlock()
+		default:
+			c.legFailed(gen)
+			return
+		}
+	}
+}
+
+// deliver passes the payload received on leg gen on to Read, and
+// acknowledges it once enough piled up. It reports false once gen is not
+// the current leg anymore.
+func (c *ResumeConn) deliver(gen int, p []byte) bool {
+	c.rmu.Lock()
+	c.mu.Lock()
+	current := gen == c.gen
+	c.mu.Unlock()
+	if !current {
+		c.rmu.Unlock()
+		return false
+	}
+	// Blocks until read, the stream is closed if that fails.
+	c.pw.Write(p)
+	c.mu.Lock()
+	c.recvd += uint64(len(p))
+	ack := c.recvd-c.ackSent >= resumeAckEvery
+	if ack {
+		c.ackSent = c.recvd
+	}
+	recvd := c.recvd
+	leg := c.leg
+	c.mu.Unlock()
+	c.rmu.Unlock()
+
+	if ack && leg != nil {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], recvd)
+		c.wmu.Lock()
+		c.writeFrame(leg, gen, resumeAck, buf[:])
+		c.wmu.Unlock()
+	}
+	return true
+}
+
+// acknowledged drops the bytes the peer received from the buffer.
+func (c *ResumeConn) acknowledged(offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset > c.acked && offset <= c.acked+uint64(len(c.unacked)) {
+		c.unacked = c.unacked[offset-c.acked:]
+		c.acked = offset
+		c.cond.Broadcast()
+	}
+}
+
+// legFailed detaches leg gen, unless another leg replaced it already. A
+// stream which both sides finished needs no other leg.
+func (c *ResumeConn) legFailed(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.leg == nil {
+		return
+	}
+	c.leg.Close()
+	c.leg = nil
+	if !c.finRcvd || !c.finAcked {
+		close(c.broken)
+	}
+}
+
+// Attached reports whether the stream has a working leg.
+func (c *ResumeConn) Attached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leg != nil
+}
+
+// writeFrame sends a frame on leg gen, c.wmu must be held. A failing leg
+// is detached, the frame is sent again on the next one if needed.
+func (c *ResumeConn) writeFrame(leg io.Writer, gen int, typ byte, payload []byte) error {
+	frame := make([]byte, 0, 3+len(payload))
+	frame = append(frame, typ)
+	if typ == resumeData {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	frame = append(frame, payload...)
+	if _, err := leg.Write(frame); err != nil {
+		c.legFailed(gen)
+		return err
+	}
+	return nil
+}
+
+// Read returns the data received from the peer, across legs.
+func (c *ResumeConn) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// Write buffers p until the peer acknowledges it and sends it on the
+// current leg, if any. It only blocks when ResumeBufferSize bytes are
+// waiting for an acknowledgement, and only fails once the stream is closed.
+func (c *ResumeConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c.mu.Lock()
+		for len(c.unacked) >= ResumeBufferSize && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return n, errors.WithStack(io.ErrClosedPipe)
+		}
+		chunk := p[:min(len(p), ResumeBufferSize-len(c.unacked), resumeMaxPayload)]
+		c.mu.Unlock()
+
+		c.wmu.Lock()
+		c.mu.Lock()
+		c.unacked = append(c.unacked, chunk...)
+		leg, gen := c.leg, c.gen
+		c.mu.Unlock()
+		if leg != nil {
+			c.writeFrame(leg, gen, resumeData, chunk)
+		}
+		c.wmu.Unlock()
+
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer that no more data follows.
+func (c *ResumeConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	c.finSent = true
+	leg, gen := c.leg, c.gen
+	c.mu.Unlock()
+	if leg != nil {
+		c.writeFrame(leg, gen, resumeFin, nil)
+	}
+	return nil
+}
+
+// Close ends the stream and closes its leg.
+func (c *ResumeConn) Close() error {
+	// Closing the pipe first unblocks a leg delivering data.
+	c.pr.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.die)
+	if c.leg != nil {
+		c.leg.Close()
+		c.leg = nil
+	}
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,144 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newLegPair returns both ends of a buffered connection, as smux streams
+// are; net.Pipe would block the handshake of Attach.
+func newLegPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept returned error: %v", err)
+	}
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c1, c2
+}
+
+// attachPair attaches both ends of a new leg to alice and bob.
+func attachPair(t *testing.T, alice, bob *ResumeConn) (net.Conn, net.Conn) {
+	c1, c2 := newLegPair(t)
+	errs := make(chan error, 1)
+	go func() { errs <- bob.Attach(c2) }()
+	if err := alice.Attach(c1); err != nil {
+		t.Fatalf("Attach returned error: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Attach returned error: %v", err)
+	}
+	return c1, c2
+}
+
+func TestResumeConnAcrossLegs(t *testing.T) {
+	alice, bob := NewResumeConn(), NewResumeConn()
+	defer alice.Close()
+	defer bob.Close()
+	leg, _ := attachPair(t, alice, bob)
+
+	payload := make([]byte, 3*resumeAckEvery+123)
+	rand.Read(payload)
+	half := len(payload) / 2
+
+	got := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(bob)
+		got <- data
+	}()
+
+	if _, err := alice.Write(payload[:half]); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	// The leg dies, writes go on into the buffer until another one is attached.
+	leg.Close()
+	select {
+	case <-alice.Broken():
+	case <-time.After(time.Second):
+		t.Fatal("broken leg not noticed")
+	}
+	if _, err := alice.Write(payload[half:]); err != nil {
+		t.Fatalf("Write returned error while detached: %v", err)
+	}
+	alice.CloseWrite()
+
+	attached := resumeAttached.Load()
+	attachPair(t, alice, bob)
+	if resumeAttached.Load() != attached+2 {
+		t.Fatal("attached legs not counted")
+	}
+
+	select {
+	case data := <-got:
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("got %d bytes, want the %d bytes written in order", len(data), len(payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not resume")
+	}
+}
+
+func TestResumeConnBothDirections(t *testing.T) {
+	alice, bob := NewResumeConn(), NewResumeConn()
+	attachPair(t, alice, bob)
+
+	go func() {
+		io.Copy(bob, bob) // echo
+		bob.CloseWrite()
+	}()
+	alice.Write([]byte("ping"))
+	alice.CloseWrite()
+	got, err := io.ReadAll(alice)
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// Once both sides finished, losing the leg needs no resume.
+	time.Sleep(50 * time.Millisecond)
+	bob.Close()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-alice.Broken():
+		t.Fatal("finished stream asks for another leg")
+	default:
+	}
+	alice.Close()
+	if _, err := alice.Write([]byte("x")); err == nil {
+		t.Fatal("Write succeeded after Close")
+	}
+}
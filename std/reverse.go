@@ -0,0 +1,56 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NetworkReverse marks streams belonging to reverse tunnels. A client opens
+// one such stream per tunnel name to register its session with the server and
+// keeps it open for as long as it serves the tunnel; the server then opens
+// streams carrying the same network and name back to the client for every
+// connection accepted on the tunnel's listener.
+const NetworkReverse = "reverse"
+
+// ParseReverseRules parses reverse tunnel rules written as "name=address"
+// into a map from name to address.
+func ParseReverseRules(entries []string) (map[string]string, error) {
+	rules := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, addr, found := strings.Cut(entry, "=")
+		if !found || name == "" || addr == "" {
+			return nil, errors.Errorf("reverse %q: expected name=address", entry)
+		}
+		if len(name) > 255 {
+			return nil, errors.Errorf("reverse %q: name too long", entry)
+		}
+		if _, ok := rules[name]; ok {
+			return nil, errors.Errorf("reverse %q: duplicate name", entry)
+		}
+		rules[name] = addr
+	}
+	return rules, nil
+}
@@ -0,0 +1,44 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import "testing"
+
+func TestParseReverseRules(t *testing.T) {
+	rules, err := ParseReverseRules([]string{"ssh=127.0.0.1:22", "web=/run/web.sock"})
+	if err != nil {
+		t.Fatalf("ParseReverseRules returned error: %v", err)
+	}
+	if rules["ssh"] != "127.0.0.1:22" || rules["web"] != "/run/web.sock" {
+		t.Fatalf("unexpected rules: %v", rules)
+	}
+
+	for _, entry := range []string{"ssh", "=127.0.0.1:22", "ssh=", ""} {
+		if _, err := ParseReverseRules([]string{entry}); err == nil {
+			t.Fatalf("expected error for %q", entry)
+		}
+	}
+	if _, err := ParseReverseRules([]string{"a=:1", "a=:2"}); err == nil {
+		t.Fatal("expected error for duplicate names")
+	}
+}
@@ -30,22 +30,26 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 
 	kcp "github.com/xtaci/kcp-go/v5"
 )
 
-const (
-	EXIT_WAIT = 5 // max seconds to wait before exit
-)
+// sigCh receives the signals sigHandler serves.
+var sigCh = make(chan os.Signal, 1)
 
 func init() {
+	// SIGHUP keeps its default, ending the process, until something is
+	// reloaded on it: a ProxyCommand of OpenSSH is ended with it.
+	watchReload = func() { signal.Notify(sigCh, syscall.SIGHUP) }
 	go sigHandler()
 }
 
+// sigHandler dumps the counters on SIGUSR1 and reloads the config on
+// SIGHUP, see OnReload. The first SIGTERM or SIGINT
+// drains the process before it exits, see Drain, a second one exits at once.
 func sigHandler() {
-	var exitOnce sync.Once
-	ch := make(chan os.Signal, 1)
+	var drainOnce sync.Once
+	ch := sigCh
 	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
 	signal.Ignore(syscall.SIGPIPE)
 
@@ -54,18 +58,27 @@ func sigHandler() {
 		switch sig {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			if s := countersString(); s != "" {
+				log.Printf("kcptun counters:%v", s)
+			}
+		case syscall.SIGHUP:
+			reload()
 		case syscall.SIGTERM, syscall.SIGINT:
-			postProcess()
-			signal.Stop(ch)
-			syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
-
-			// wait for max EXIT_WAIT seconds before exit
-			exitOnce.Do(func() {
+			again := true
+			drainOnce.Do(func() {
+				again = false
+				log.Println("signal:", sig, "draining, send it again to exit now")
 				go func() {
-					time.Sleep(EXIT_WAIT * time.Second)
+					Drain()
+					postProcess()
 					os.Exit(0)
 				}()
 			})
+			if again {
+				postProcess()
+				signal.Stop(ch)
+				syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+			}
 		}
 	}
 }
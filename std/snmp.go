@@ -24,15 +24,87 @@ package std
 
 import (
 	"encoding/csv"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	kcp "github.com/xtaci/kcp-go/v5"
 )
 
+// Counter is a kcptun statistic logged next to the KCP SNMP counters.
+type Counter struct {
+	name string
+	n    atomic.Uint64
+}
+
+var (
+	countersMu sync.Mutex
+	counters   []*Counter
+)
+
+// NewCounter registers a counter, name becomes its column in the SNMP log.
+func NewCounter(name string) *Counter {
+	c := &Counter{name: name}
+	countersMu.Lock()
+	counters = append(counters, c)
+	countersMu.Unlock()
+	return c
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() { c.n.Add(1) }
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) { c.n.Add(n) }
+
+// Dec subtracts one from the counter, for those counting what is open.
+func (c *Counter) Dec() { c.n.Add(^uint64(0)) }
+
+// Store sets the counter, for those reporting a state.
+func (c *Counter) Store(n uint64) { c.n.Store(n) }
+
+// Load returns the current value of the counter.
+func (c *Counter) Load() uint64 { return c.n.Load() }
+
+// snmpHeader returns the column names of the SNMP log.
+func snmpHeader() []string {
+	header := kcp.DefaultSnmp.Header()
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	for _, c := range counters {
+		header = append(header, c.name)
+	}
+	return header
+}
+
+// snmpValues returns the current values of the SNMP log columns.
+func snmpValues() []string {
+	values := kcp.DefaultSnmp.ToSlice()
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	for _, c := range counters {
+		values = append(values, strconv.FormatUint(c.Load(), 10))
+	}
+	return values
+}
+
+// countersString formats the registered counters for the log.
+func countersString() string {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	var s string
+	for _, c := range counters {
+		s += " " + c.name + ":" + strconv.FormatUint(c.Load(), 10)
+	}
+	return s
+}
+
 func SnmpLogger(path string, interval int) {
 	if path == "" || interval <= 0 {
 		return
@@ -53,7 +125,8 @@ func writeSnmpRecord(path string) error {
 	// split path into dirname and filename
 	logdir, logfile := filepath.Split(path)
 	// only format logfile
-	f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	header := append([]string{"Unix"}, snmpHeader()...)
+	f, err := openSnmpLog(logdir+time.Now().Format(logfile), header)
 	if err != nil {
 		return err
 	}
@@ -62,13 +135,34 @@ func writeSnmpRecord(path string) error {
 	w := csv.NewWriter(f)
 	// write header in empty file
 	if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
-		if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
+		if err := w.Write(header); err != nil {
 			return err
 		}
 	}
-	if err := w.Write(append([]string{strconv.FormatInt(time.Now().Unix(), 10)}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
+	if err := w.Write(append([]string{strconv.FormatInt(time.Now().Unix(), 10)}, snmpValues()...)); err != nil {
 		return err
 	}
 	w.Flush()
 	return w.Error()
 }
+
+// openSnmpLog opens the SNMP log file for appending. A file whose header
+// differs from the current columns, eg: one written before an upgrade that
+// added counters, is renamed to name.<unix time> and a new one is started,
+// so every file keeps the columns its records were written with.
+func openSnmpLog(name string, header []string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	old, err := csv.NewReader(f).Read()
+	if err == io.EOF || (err == nil && slices.Equal(old, header)) {
+		return f, nil
+	}
+	f.Close()
+
+	if err := os.Rename(name, name+"."+strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+}
@@ -0,0 +1,109 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestSnmpRecordCounters(t *testing.T) {
+	c := NewCounter("TestEvents")
+	c.Inc()
+	c.Inc()
+
+	path := filepath.Join(t.TempDir(), "snmp.log")
+	for i := 0; i < 2; i++ {
+		if err := writeSnmpRecord(path); err != nil {
+			t.Fatalf("writeSnmpRecord returned error: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the log: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected a header and 2 records, got %d lines", len(records))
+	}
+
+	header := records[0]
+	if len(header) != 1+len(kcp.DefaultSnmp.Header())+len(counters) {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	col := -1
+	for i, name := range header {
+		if name == "TestEvents" {
+			col = i
+		}
+	}
+	if col < 0 {
+		t.Fatalf("counter column missing from header: %v", header)
+	}
+	if records[2][col] != "2" {
+		t.Fatalf("expected counter value 2, got %q", records[2][col])
+	}
+}
+
+func TestSnmpLogHeaderChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snmp.log")
+	if err := os.WriteFile(path, []byte("Unix,BytesSent\n1,2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := writeSnmpRecord(path); err != nil {
+			t.Fatalf("writeSnmpRecord returned error: %v", err)
+		}
+	}
+
+	moved, err := filepath.Glob(path + ".*")
+	if err != nil || len(moved) != 1 {
+		t.Fatalf("expected the old log moved aside once, got %v %v", moved, err)
+	}
+	if b, err := os.ReadFile(moved[0]); err != nil || string(b) != "Unix,BytesSent\n1,2\n" {
+		t.Fatalf("old log altered: %q %v", b, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the log: %v", err)
+	}
+	if len(records) != 3 || !slices.Equal(records[0], append([]string{"Unix"}, snmpHeader()...)) {
+		t.Fatalf("expected the current header and 2 records, got %v", records)
+	}
+}
@@ -0,0 +1,45 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package stdtest holds the fixtures shared by the tests of the client and
+// the server.
+package stdtest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+// NewSession returns a client smux session over an in-memory pipe, which is
+// closed when the test ends. Nothing answers on the other end, so it only
+// serves tests that need a live session to hold on to.
+func NewSession(t testing.TB) *smux.Session {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c2.Close() })
+	session, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Client returned error: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}